@@ -1,45 +1,205 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jn-lp/se-lab22/cmd"
 	"github.com/jn-lp/se-lab22/datastore"
 	"github.com/jn-lp/se-lab22/httptools"
+	"github.com/jn-lp/se-lab22/metrics"
+	"github.com/jn-lp/se-lab22/replication"
 	"github.com/jn-lp/se-lab22/signal"
 )
 
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+	// incrOp is the op query parameter that turns a POST into an increment,
+	// a path suffix would collide with keys.
+	incrOp = "incr"
+
+	// maxTTL keeps expiry times, stored in nanoseconds, from overflowing.
+	maxTTL = 100 * 365 * 24 * 60 * 60
+
+	// confEncryptionKeys holds the encryption keys in the -key-file format,
+	// with a comma allowed in place of a new line.
+	confEncryptionKeys = "DB_ENCRYPTION_KEYS"
+
+	// watchDuration ends event streams before the server write timeout does,
+	// clients reconnect with the Last-Event-ID header to resume.
+	watchDuration = 8 * time.Second
+)
+
+var compactionPolicies = map[string]datastore.CompactionPolicy{
+	"all":         datastore.MergeAll{},
+	"size-tiered": datastore.SizeTiered{MinSegments: 4, Ratio: 2},
+	"garbage":     datastore.GarbageRatio{Threshold: 0.5},
+	"none":        nil,
+}
+
+// store is the key space a request works on, the datastore itself or one of
+// its buckets.
+type store interface {
+	GetWithVersion(key string) ([]byte, uint64, error)
+	Put(key string, value []byte) error
+	PutWithExpiry(key string, value []byte, expiresAt time.Time) error
+	Delete(key string) error
+	CompareAndSwap(key string, version uint64, value []byte) error
+	PutIfAbsent(key string, value []byte) error
+	Increment(key string, delta int64) (int64, error)
+	Prefix(p string) *datastore.Iterator
+}
+
+var codecs = map[string]datastore.Codec{
+	"gzip": datastore.Gzip,
+	"none": datastore.NoCompression,
+}
+
 func main() {
 	var (
-		port = flag.Int("port", 8070, "server port")
-		dir  = flag.String("dir", ".", "database storage dir")
+		port         = flag.Int("port", 8070, "server port")
+		dir          = flag.String("dir", ".", "database storage dir")
+		syncMode     = flag.String("sync", "never", "when to fsync writes: always, interval or never")
+		syncInterval = flag.Duration("sync-interval", 100*time.Millisecond, "fsync period of the interval sync mode")
+		compaction   = flag.String("compaction", "all", "segment compaction policy: all, size-tiered, garbage or none")
+		mergeRate    = flag.Int64("compaction-rate", 0, "compaction I/O budget in bytes per second, 0 for no limit")
+		backupDir    = flag.String("backup-dir", "", "where POST /admin/backup puts checkpoints, backups in the storage dir by default")
+		leader       = flag.String("leader", "", "URL of the db to replicate, makes this one a read-only follower")
+		compression  = flag.String("compression", "none", "codec new segments are compressed with: gzip or none")
+		keyFile      = flag.String("key-file", "", "file of <id>:<hex key> lines to encrypt segments with, the last key is used for new data")
 	)
 	flag.Parse()
 
-	db, err := datastore.NewDatastore(*dir)
+	mode, err := datastore.ParseSyncMode(*syncMode)
+	if err != nil {
+		log.Printf("invalid sync mode: %v\n", err)
+
+		return
+	}
+
+	policy, ok := compactionPolicies[*compaction]
+	if !ok {
+		log.Printf("unknown compaction policy %q\n", *compaction)
+
+		return
+	}
+
+	codec, ok := codecs[*compression]
+	if !ok {
+		log.Printf("unknown compression codec %q\n", *compression)
+
+		return
+	}
+
+	keyring, err := loadKeyring(*keyFile)
+	if err != nil {
+		log.Printf("cannot load encryption keys: %v\n", err)
+
+		return
+	}
+
+	db, err := datastore.Open(
+		*dir,
+		datastore.WithSyncMode(mode, *syncInterval),
+		datastore.WithCompactionPolicy(policy),
+	)
 	if err != nil {
 		log.Printf("cannot create database instance: %v\n", err)
 
 		return
 	}
 
+	if *backupDir == "" {
+		*backupDir = filepath.Join(*dir, "backups")
+	}
+
+	db.SetKeyring(keyring)
+
+	if err = db.SetCompression(codec); err != nil {
+		log.Printf("cannot set compression: %v\n", err)
+
+		return
+	}
+
+	if err = db.SetCompactionRate(*mergeRate); err != nil {
+		log.Printf("cannot set compaction rate: %v\n", err)
+
+		return
+	}
+
+	registry := metrics.NewRegistry()
+	registerMetrics(registry, db)
+
 	h := new(http.ServeMux)
 	h.HandleFunc("/db/", func(rw http.ResponseWriter, r *http.Request) {
 		rw.Header().Set("Content-Type", "application/json")
 
-		key := strings.TrimPrefix(r.URL.Path, "/db/")
-		if r.Method == http.MethodGet {
-			var value []byte
+		if *leader != "" && r.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/db/")
+		incr := r.Method == http.MethodPost && r.URL.Query().Get("op") == incrOp
+
+		// Keys of buckets are addressed as /db/{bucket}/{key}.
+		var (
+			s      store = db
+			bucket *datastore.Bucket
+			key    = path
+		)
+
+		if i := strings.Index(path, "/"); i >= 0 {
+			b, err := db.Bucket(path[:i])
+			if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
 
-			value, err = db.Get(key)
-			if errors.Is(err, datastore.ErrNotFound) || value == nil {
+				return
+			}
+
+			s, bucket, key = b, b, path[i+1:]
+		}
+
+		if incr {
+			increment(s, key, rw, r)
+		} else if r.Method == http.MethodGet && key == "" {
+			res, err := list(s, r.URL.Query())
+			if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+
+				return
+			}
+
+			if err = json.NewEncoder(rw).Encode(res); err != nil {
+				log.Println(err)
+			}
+		} else if r.Method == http.MethodGet {
+			var (
+				value   []byte
+				version uint64
+			)
+
+			value, version, err = s.GetWithVersion(key)
+			if errors.Is(err, datastore.ErrReservedKey) {
+				rw.WriteHeader(http.StatusBadRequest)
+
+				return
+			} else if errors.Is(err, datastore.ErrNotFound) || value == nil {
 				rw.WriteHeader(http.StatusNotFound)
 
 				return
@@ -58,6 +218,8 @@ func main() {
 				return
 			}
 
+			rw.Header().Set("ETag", etag(version))
+
 			if _, err = rw.Write(b); err != nil {
 				rw.WriteHeader(http.StatusInternalServerError)
 
@@ -83,16 +245,466 @@ func main() {
 				return
 			}
 
-			if err = db.Put(key, req.Value); err != nil {
+			if req.TTL < 0 || req.TTL > maxTTL {
+				rw.WriteHeader(http.StatusBadRequest)
+
+				return
+			}
+
+			ifMatch := r.Header.Get("If-Match")
+			ifNoneMatch := r.Header.Get("If-None-Match")
+
+			switch {
+			case ifMatch != "" || ifNoneMatch != "":
+				if req.TTL > 0 {
+					rw.WriteHeader(http.StatusBadRequest)
+
+					return
+				}
+
+				err = conditionalPut(s, key, req.Value, ifMatch, ifNoneMatch)
+			case req.TTL > 0:
+				err = s.PutWithExpiry(key, req.Value, time.Now().Add(time.Duration(req.TTL)*time.Second))
+			default:
+				err = s.Put(key, req.Value)
+			}
+
+			if errors.Is(err, datastore.ErrVersionConflict) {
+				rw.WriteHeader(http.StatusPreconditionFailed)
+
+				return
+			} else if errors.Is(err, errBadPrecondition) || errors.Is(err, datastore.ErrReservedKey) {
+				rw.WriteHeader(http.StatusBadRequest)
+
+				return
+			} else if err != nil {
 				rw.WriteHeader(http.StatusInternalServerError)
 
 				return
 			}
 
 			rw.WriteHeader(http.StatusOK)
+		} else if r.Method == http.MethodDelete && bucket != nil && key == "" {
+			if err = bucket.Drop(); err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+
+				return
+			}
+
+			rw.WriteHeader(http.StatusOK)
+		} else if r.Method == http.MethodDelete {
+			if err = s.Delete(key); errors.Is(err, datastore.ErrReservedKey) {
+				rw.WriteHeader(http.StatusBadRequest)
+
+				return
+			} else if err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+
+				return
+			}
+
+			rw.WriteHeader(http.StatusOK)
+		}
+	})
+
+	h.HandleFunc("/db/_batch", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodPost {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		if *leader != "" {
+			rw.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		defer func(Body io.ReadCloser) {
+			_ = Body.Close()
+		}(r.Body)
+
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		var req cmd.BatchRequest
+
+		if err = json.Unmarshal(body, &req); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		var batch datastore.WriteBatch
+
+		for _, op := range req.Operations {
+			if op.Delete {
+				batch.Delete(op.Key)
+			} else {
+				batch.Put(op.Key, op.Value)
+			}
+		}
+
+		if err = db.Write(&batch); errors.Is(err, datastore.ErrReservedKey) {
+			rw.WriteHeader(http.StatusBadRequest)
+
+			return
+		} else if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	h.HandleFunc("/admin/compaction-rate", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			var req cmd.CompactionRate
+
+			err := json.NewDecoder(r.Body).Decode(&req)
+			_ = r.Body.Close()
+
+			if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+
+				return
+			}
+
+			if err = db.SetCompactionRate(req.BytesPerSecond); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+
+				return
+			}
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		if err := json.NewEncoder(rw).Encode(cmd.CompactionRate{BytesPerSecond: db.CompactionRate()}); err != nil {
+			log.Println(err)
+		}
+	})
+
+	h.HandleFunc("/admin/stats", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		if err := json.NewEncoder(rw).Encode(stats(db)); err != nil {
+			log.Println(err)
 		}
 	})
 
-	httptools.CreateServer(*port, h).Start()
+	h.HandleFunc("/admin/backup", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodPost {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		target := filepath.Join(*backupDir, time.Now().UTC().Format("20060102T150405.000000000"))
+
+		if err := db.Checkpoint(target); err != nil {
+			log.Printf("cannot back up to %s: %v", target, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		if err := json.NewEncoder(rw).Encode(cmd.BackupResponse{Dir: target}); err != nil {
+			log.Println(err)
+		}
+	})
+
+	h.HandleFunc("/db/_watch", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		watch(db, rw, r)
+	})
+
+	// Every db serves its log, so that followers can be chained.
+	h.Handle("/replication/", replication.Handler(db))
+
+	if *leader != "" {
+		f := replication.NewFollower(db, strings.TrimSuffix(*leader, "/"))
+		h.Handle(replication.StatusPath, f)
+
+		go f.Run(context.Background())
+	}
+
+	h.Handle("/metrics", registry)
+
+	httptools.CreateServer(*port, metrics.NewHTTPMetrics(registry).InstrumentMux(h)).Start()
 	signal.WaitForTerminationSignal()
 }
+
+// increment serves POST /db/{key}?op=incr, an empty body adds one.
+func increment(s store, key string, rw http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(r.Body)
+
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+
+		return
+	}
+
+	req := cmd.IncrementRequest{Delta: 1}
+
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, &req); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	n, err := s.Increment(key, req.Delta)
+	if errors.Is(err, datastore.ErrReservedKey) {
+		rw.WriteHeader(http.StatusBadRequest)
+
+		return
+	} else if errors.Is(err, datastore.ErrNotInteger) || errors.Is(err, datastore.ErrOverflow) {
+		rw.WriteHeader(http.StatusConflict)
+
+		return
+	} else if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	if err = json.NewEncoder(rw).Encode(cmd.IncrementResponse{Key: key, Value: n}); err != nil {
+		log.Println(err)
+	}
+}
+
+// watch streams the changes of keys with the prefix query parameter, in the
+// bucket one if it is set, as Server-Sent Events. The stream starts after the
+// sequence number in the Last-Event-ID header or the from parameter, with
+// changes made from now on if neither is set.
+func watch(db *datastore.Datastore, rw http.ResponseWriter, r *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		rw.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	from := db.Seq()
+
+	for _, s := range []string{r.URL.Query().Get("from"), r.Header.Get("Last-Event-ID")} {
+		if s == "" {
+			continue
+		}
+
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		from = n
+	}
+
+	var w *datastore.Watcher
+
+	if name := r.URL.Query().Get("bucket"); name != "" {
+		bucket, err := db.Bucket(name)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		w = bucket.Watch(r.URL.Query().Get("prefix"), from)
+	} else {
+		w = db.Watch(r.URL.Query().Get("prefix"), from)
+	}
+
+	defer w.Close()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	timeout := time.NewTimer(watchDuration)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case e, ok := <-w.Events():
+			if !ok {
+				if err := w.Err(); err != nil {
+					_, _ = fmt.Fprintf(rw, "event: error\ndata: %s\n\n", err)
+					flusher.Flush()
+				}
+
+				return
+			}
+
+			data, err := json.Marshal(cmd.WatchEvent{Seq: e.Seq, Key: e.Key, Value: e.Value, Deleted: e.Deleted})
+			if err != nil {
+				log.Println(err)
+
+				return
+			}
+
+			kind := "put"
+			if e.Deleted {
+				kind = "delete"
+			}
+
+			if _, err = fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, kind, data); err != nil {
+				return
+			}
+
+			flusher.Flush()
+		case <-timeout.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+var errBadPrecondition = errors.New("unsupported precondition")
+
+func etag(version uint64) string {
+	return strconv.Quote(strconv.FormatUint(version, 10))
+}
+
+// conditionalPut maps If-Match with a version ETag to CompareAndSwap and
+// If-None-Match: * to PutIfAbsent.
+func conditionalPut(s store, key string, value []byte, ifMatch, ifNoneMatch string) error {
+	if ifMatch != "" && ifNoneMatch != "" {
+		return errBadPrecondition
+	}
+
+	if ifNoneMatch != "" {
+		if ifNoneMatch != "*" {
+			return errBadPrecondition
+		}
+
+		return s.PutIfAbsent(key, value)
+	}
+
+	tag, err := strconv.Unquote(ifMatch)
+	if err != nil {
+		return errBadPrecondition
+	}
+
+	version, err := strconv.ParseUint(tag, 10, 64)
+	if err != nil || version == 0 {
+		return errBadPrecondition
+	}
+
+	return s.CompareAndSwap(key, version, value)
+}
+
+// list serves a page of keys starting with the prefix query parameter. The
+// Next field of a response is the after parameter for the following page.
+func list(s store, query url.Values) (cmd.ListResponse, error) {
+	var (
+		res    = cmd.ListResponse{Items: []cmd.GetResponse{}}
+		prefix = query.Get("prefix")
+		after  = query.Get("after")
+		limit  = defaultListLimit
+	)
+
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return res, fmt.Errorf("invalid limit %q", l)
+		}
+
+		if limit = n; limit > maxListLimit {
+			limit = maxListLimit
+		}
+	}
+
+	it := s.Prefix(prefix)
+	if after != "" {
+		it.Seek(after + "\x00")
+	}
+
+	for it.Next() {
+		if len(res.Items) == limit {
+			res.Next = res.Items[limit-1].Key
+
+			break
+		}
+
+		res.Items = append(res.Items, cmd.GetResponse{Key: it.Key(), Value: it.Value()})
+	}
+
+	return res, it.Err()
+}
+
+// stats converts the datastore report for GET /admin/stats.
+func stats(db *datastore.Datastore) cmd.StatsResponse {
+	s := db.Stats()
+	res := cmd.StatsResponse{
+		Segments:               make([]cmd.SegmentStats, len(s.Segments)),
+		Size:                   s.Size,
+		DeadBytes:              s.DeadBytes,
+		LiveKeys:               s.LiveKeys,
+		Merges:                 s.Merges,
+		MergeDuration:          s.MergeDuration.Seconds(),
+		LastMergeDuration:      s.LastMergeDuration.Seconds(),
+		PutQueueDepth:          s.PutQueueDepth,
+		SemaphoreWait:          s.SemaphoreWait.Seconds(),
+		BloomNegatives:         s.BloomNegatives,
+		BloomFalsePositives:    s.BloomFalsePositives,
+		BloomFalsePositiveRate: s.BloomFalsePositiveRate,
+		CompactionRate:         s.CompactionRate,
+		CompactionBytes:        s.CompactionBytes,
+		CompactionThrottled:    s.CompactionThrottled.Seconds(),
+	}
+
+	for i, seg := range s.Segments {
+		res.Segments[i] = cmd.SegmentStats{ID: seg.ID, Size: seg.Size, LiveBytes: seg.LiveBytes}
+	}
+
+	return res
+}
+
+// loadKeyring reads the encryption keys from the key file or, without one,
+// from the environment. Segments are not encrypted if neither is set.
+func loadKeyring(keyFile string) (*datastore.Keyring, error) {
+	if keyFile != "" {
+		return datastore.LoadKeyring(keyFile)
+	}
+
+	if keys := os.Getenv(confEncryptionKeys); keys != "" {
+		return datastore.ParseKeyring(keys)
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/jn-lp/se-lab22/datastore"
+	"github.com/jn-lp/se-lab22/metrics"
+)
+
+// registerMetrics exposes the datastore stats, which are read once a scrape.
+// Live keys are left to /admin/stats, counting them reads every key.
+func registerMetrics(r *metrics.Registry, db *datastore.Datastore) {
+	var (
+		mutex sync.Mutex
+		stats datastore.Stats
+	)
+
+	r.OnCollect(func() {
+		s := db.QuickStats()
+
+		mutex.Lock()
+		stats = s
+		mutex.Unlock()
+	})
+
+	for _, m := range []struct {
+		name    string
+		help    string
+		counter bool
+		value   func(s *datastore.Stats) float64
+	}{
+		{"datastore_segments", "Segments on disk, the active one included.", false, func(s *datastore.Stats) float64 {
+			return float64(len(s.Segments))
+		}},
+		{"datastore_size_bytes", "Total size of the segments.", false, func(s *datastore.Stats) float64 {
+			return float64(s.Size)
+		}},
+		{"datastore_dead_bytes", "Size of overwritten records merges have yet to drop.", false, func(s *datastore.Stats) float64 {
+			return float64(s.DeadBytes)
+		}},
+		{"datastore_merges_total", "Merges made since start.", true, func(s *datastore.Stats) float64 {
+			return float64(s.Merges)
+		}},
+		{"datastore_merge_seconds_total", "Time spent merging segments.", true, func(s *datastore.Stats) float64 {
+			return s.MergeDuration.Seconds()
+		}},
+		{"datastore_put_queue_depth", "Writes waiting for or being written by the writer.", false, func(s *datastore.Stats) float64 {
+			return float64(s.PutQueueDepth)
+		}},
+		{"datastore_semaphore_wait_seconds_total", "Time reads spent waiting for a read slot.", true, func(s *datastore.Stats) float64 {
+			return s.SemaphoreWait.Seconds()
+		}},
+		{"datastore_bloom_negatives_total", "Segment lookups skipped by a bloom filter.", true, func(s *datastore.Stats) float64 {
+			return float64(s.BloomNegatives)
+		}},
+		{"datastore_bloom_false_positives_total", "Segment lookups a bloom filter let through in vain.", true, func(s *datastore.Stats) float64 {
+			return float64(s.BloomFalsePositives)
+		}},
+		{"datastore_compaction_rate_bytes", "Compaction budget per second, zero when unlimited.", false, func(s *datastore.Stats) float64 {
+			return float64(s.CompactionRate)
+		}},
+		{"datastore_compaction_bytes_total", "Bytes read and written by compaction.", true, func(s *datastore.Stats) float64 {
+			return float64(s.CompactionBytes)
+		}},
+		{"datastore_compaction_throttled_seconds_total", "Time compaction waited for budget.", true, func(s *datastore.Stats) float64 {
+			return s.CompactionThrottled.Seconds()
+		}},
+	} {
+		value := m.value
+		read := func() float64 {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			return value(&stats)
+		}
+
+		if m.counter {
+			r.CounterFunc(m.name, m.help, read)
+		} else {
+			r.GaugeFunc(m.name, m.help, read)
+		}
+	}
+
+	r.CounterFunc("datastore_seq", "Sequence number of the latest write.", func() float64 {
+		return float64(db.Seq())
+	})
+}
@@ -2,9 +2,83 @@ package cmd
 
 type PutRequest struct {
 	Value []byte
+	// TTL is the lifetime of the value in seconds, zero keeps it forever.
+	TTL int64
 }
 
 type GetResponse struct {
 	Key   string
 	Value []byte
 }
+
+type BatchOperation struct {
+	Key    string
+	Value  []byte
+	Delete bool
+}
+
+type BatchRequest struct {
+	Operations []BatchOperation
+}
+
+type ListResponse struct {
+	Items []GetResponse
+	Next  string
+}
+
+type IncrementRequest struct {
+	Delta int64
+}
+
+type IncrementResponse struct {
+	Key   string
+	Value int64
+}
+
+type CompactionRate struct {
+	// BytesPerSecond limits compaction I/O, zero means no limit.
+	BytesPerSecond int64
+}
+
+type BackupResponse struct {
+	// Dir is the checkpoint directory, it can be restored with
+	// datastore.Restore.
+	Dir string
+}
+
+type WatchEvent struct {
+	Seq     uint64
+	Key     string
+	Value   []byte
+	Deleted bool
+}
+
+type SegmentStats struct {
+	// ID is -1 for the active segment.
+	ID        int
+	Size      int64
+	LiveBytes int64
+}
+
+// StatsResponse reports the datastore internals, durations are in seconds.
+type StatsResponse struct {
+	Segments  []SegmentStats
+	Size      int64
+	DeadBytes int64
+	LiveKeys  int
+
+	Merges            int64
+	MergeDuration     float64
+	LastMergeDuration float64
+
+	PutQueueDepth int64
+	SemaphoreWait float64
+
+	BloomNegatives         int64
+	BloomFalsePositives    int64
+	BloomFalsePositiveRate float64
+
+	CompactionRate      int64
+	CompactionBytes     int64
+	CompactionThrottled float64
+}
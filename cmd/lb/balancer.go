@@ -38,6 +38,8 @@ func (l *LoadBalancer) SetServers(urls ...string) {
 	for _, rawURL := range urls {
 		u, _ := url.Parse(rawURL)
 		l.pool = append(l.pool, New(u))
+
+		backendUp.Set(0, rawURL)
 	}
 }
 
@@ -55,6 +57,12 @@ func (l *LoadBalancer) Start(healthEvery time.Duration) {
 				}
 
 				l.pool[j].SetAlive(alive)
+
+				if alive {
+					backendUp.Set(1, serverToCheck.String())
+				} else {
+					backendUp.Set(0, serverToCheck.String())
+				}
 			}
 		}()
 	}
@@ -81,6 +89,7 @@ func (l *LoadBalancer) Proxy(rw http.ResponseWriter, r *http.Request) error {
 	resp, err := http.DefaultClient.Do(fwdRequest)
 	if err != nil {
 		log.Printf("Failed to get response from %s: %s", dst, err)
+		backendRequests.Inc(dst.String(), "0")
 		rw.WriteHeader(http.StatusServiceUnavailable)
 
 		return err
@@ -97,6 +106,7 @@ func (l *LoadBalancer) Proxy(rw http.ResponseWriter, r *http.Request) error {
 	}
 
 	log.Println("fwd", resp.StatusCode, resp.Request.URL)
+	backendRequests.Inc(dst.String(), strconv.Itoa(resp.StatusCode))
 	rw.WriteHeader(resp.StatusCode)
 
 	defer resp.Body.Close()
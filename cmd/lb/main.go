@@ -3,9 +3,11 @@ package main
 import (
 	"flag"
 	"log"
+	"net/http"
 	"time"
 
 	"github.com/jn-lp/se-lab22/httptools"
+	"github.com/jn-lp/se-lab22/metrics"
 	"github.com/jn-lp/se-lab22/signal"
 )
 
@@ -55,7 +57,11 @@ func main() {
 
 	lb.Start(10 * time.Second)
 
-	frontend := httptools.CreateServer(*port, lb)
+	h := http.NewServeMux()
+	h.Handle("/metrics", registry)
+	h.Handle("/", lb)
+
+	frontend := httptools.CreateServer(*port, metrics.NewHTTPMetrics(registry).InstrumentMux(h))
 
 	log.Println("Starting load balancer...")
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
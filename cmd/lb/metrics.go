@@ -0,0 +1,18 @@
+package main
+
+import "github.com/jn-lp/se-lab22/metrics"
+
+var (
+	registry = metrics.NewRegistry()
+
+	backendUp = registry.Gauge(
+		"lb_backend_up",
+		"Whether a backend passed its last health check.",
+		"backend",
+	)
+	backendRequests = registry.Counter(
+		"lb_backend_requests_total",
+		"Requests forwarded to a backend by response status, 0 when it did not answer.",
+		"backend", "status",
+	)
+)
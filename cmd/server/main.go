@@ -13,6 +13,7 @@ import (
 
 	"github.com/jn-lp/se-lab22/cmd"
 	"github.com/jn-lp/se-lab22/httptools"
+	"github.com/jn-lp/se-lab22/metrics"
 	"github.com/jn-lp/se-lab22/signal"
 )
 
@@ -85,7 +86,10 @@ func main() {
 
 	h.Handle("/report", report)
 
-	server := httptools.CreateServer(*port, h)
+	registry := metrics.NewRegistry()
+	h.Handle("/metrics", registry)
+
+	server := httptools.CreateServer(*port, metrics.NewHTTPMetrics(registry).InstrumentMux(h))
 	server.Start()
 
 	signal.WaitForTerminationSignal()
@@ -0,0 +1,40 @@
+package datastore
+
+import "encoding/binary"
+
+// WriteBatch groups puts and deletes that are applied atomically by
+// Datastore.Write. The zero value is an empty batch ready to use.
+type WriteBatch struct {
+	entries []*entry
+}
+
+func (b *WriteBatch) Put(key string, value []byte) {
+	b.entries = append(b.entries, &entry{kind: entryPut, key: key, value: value})
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.entries = append(b.entries, &entry{kind: entryDelete, key: key})
+}
+
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+// Write applies every operation of the batch or, if the process dies while
+// the batch is being written, none of them.
+func (db *Datastore) Write(b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+
+	return db.write(b.entries...)
+}
+
+// batchHeader precedes the records of a batch and holds their count.
+func batchHeader(count int) *entry {
+	value := make([]byte, 4)
+
+	binary.LittleEndian.PutUint32(value, uint32(count))
+
+	return &entry{kind: entryBatch, value: value}
+}
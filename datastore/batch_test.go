@@ -0,0 +1,149 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDatastore_Write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Put("key1", dataset["key1"]); err != nil {
+		t.Fatal(err)
+	}
+
+	var b WriteBatch
+
+	b.Put("key2", dataset["key2"])
+	b.Put("key3", dataset["key3"])
+	b.Delete("key1")
+
+	if err = db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T) {
+		if _, err := db.Get("key1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected %s, got %v", ErrNotFound, err)
+		}
+
+		for _, key := range []string{"key2", "key3"} {
+			value, err := db.Get(key)
+			if err != nil {
+				t.Errorf("can't get %s: %s", key, err)
+			}
+
+			if !bytes.Equal(value, dataset[key]) {
+				t.Errorf("wrong value returned expected %s, got %s", dataset[key], value)
+			}
+		}
+	}
+
+	t.Run("apply", check)
+
+	t.Run("new db process", func(t *testing.T) {
+		if err = db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if db, err = NewDatastore(dir); err != nil {
+			t.Fatal(err)
+		}
+
+		check(t)
+	})
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDatastore_WriteTorn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Put("key1", dataset["key1"]); err != nil {
+		t.Fatal(err)
+	}
+
+	batchOffset := db.segments[0].offset
+
+	var b WriteBatch
+
+	b.Put("key1", anotherDataset["key2"])
+	b.Put("key2", dataset["key2"])
+
+	if err = db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	currentPath := filepath.Join(dir, segmentPrefix+currentSegmentSuffix)
+
+	data, err := ioutil.ReadFile(currentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for size := batchOffset + 1; size < int64(len(data)); size++ {
+		if err = ioutil.WriteFile(currentPath, data[:size], 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if db, err = NewDatastore(dir); err != nil {
+			t.Fatalf("torn at %d: can't open: %s", size, err)
+		}
+
+		if value, err := db.Get("key1"); err != nil || !bytes.Equal(value, dataset["key1"]) {
+			t.Errorf("torn at %d: batch was partially applied to key1: %s, %v", size, value, err)
+		}
+
+		if _, err = db.Get("key2"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("torn at %d: batch was partially applied to key2: %v", size, err)
+		}
+
+		if db.segments[0].offset != batchOffset {
+			t.Errorf("torn at %d: expected truncation to %d, got %d", size, batchOffset, db.segments[0].offset)
+		}
+
+		if err = db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
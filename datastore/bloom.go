@@ -0,0 +1,169 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+const (
+	bloomSuffix = ".bloom"
+	// bloomFalsePositiveRate is the rate filters of sealed segments are sized for.
+	bloomFalsePositiveRate = 0.01
+)
+
+var errInvalidBloom = errors.New("invalid bloom filter file")
+
+// bloomFilter answers whether a sealed segment may hold a key, so that
+// lookups of missing keys skip the segment without touching its index.
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint32
+}
+
+func newBloomFilter(keys int, fpRate float64) *bloomFilter {
+	if keys < 1 {
+		keys = 1
+	}
+
+	m := math.Ceil(-float64(keys) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(keys)*math.Ln2))
+
+	return &bloomFilter{
+		bits:   make([]uint64, (int(m)+63)/64),
+		hashes: uint32(k),
+	}
+}
+
+// locations derives the bits of a key from two halves of its FNV-1a hash.
+func (f *bloomFilter) locations(key string, fn func(bit uint64)) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum&math.MaxUint32, sum>>32
+	m := uint64(len(f.bits) * 64)
+
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		fn((h1 + i*h2) % m)
+	}
+}
+
+func (f *bloomFilter) add(key string) {
+	f.locations(key, func(bit uint64) {
+		f.bits[bit/64] |= 1 << (bit % 64)
+	})
+}
+
+func (f *bloomFilter) mayContain(key string) bool {
+	contains := true
+
+	f.locations(key, func(bit uint64) {
+		contains = contains && f.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+
+	return contains
+}
+
+// Encode lays the filter out as the number of hashes followed by the bits.
+func (f *bloomFilter) Encode() []byte {
+	res := make([]byte, 4+len(f.bits)*8)
+
+	binary.LittleEndian.PutUint32(res, f.hashes)
+
+	for i, word := range f.bits {
+		binary.LittleEndian.PutUint64(res[4+i*8:], word)
+	}
+
+	return res
+}
+
+func (f *bloomFilter) Decode(input []byte) error {
+	if len(input) < 12 || (len(input)-4)%8 != 0 {
+		return errInvalidBloom
+	}
+
+	if f.hashes = binary.LittleEndian.Uint32(input); f.hashes == 0 {
+		return errInvalidBloom
+	}
+
+	f.bits = make([]uint64, (len(input)-4)/8)
+
+	for i := range f.bits {
+		f.bits[i] = binary.LittleEndian.Uint64(input[4+i*8:])
+	}
+
+	return nil
+}
+
+// buildFilter fills the filter of a sealed segment from its index and keeps
+// it next to the segment, prefixed with the segment size and sequence number
+// and followed by a CRC32C of the whole file.
+func (s *segment) buildFilter() {
+	f := newBloomFilter(len(s.index), bloomFalsePositiveRate)
+	for key := range s.index {
+		f.add(key)
+	}
+
+	s.filter = f
+
+	if s.readOnly {
+		return
+	}
+
+	data := make([]byte, 16)
+
+	binary.LittleEndian.PutUint64(data, uint64(s.offset))
+	binary.LittleEndian.PutUint64(data[8:], s.seq)
+	data = append(data, f.Encode()...)
+	data = append(data, make([]byte, 4)...)
+	binary.LittleEndian.PutUint32(data[len(data)-4:], crc32.Checksum(data[:len(data)-4], crcTable))
+
+	if err := ioutil.WriteFile(s.path+bloomSuffix, data, 0o600); err != nil {
+		s.logf("can't write bloom filter of %s: %v", s.path, err)
+	}
+}
+
+// loadFilter reads the filter stored next to a sealed segment and rebuilds
+// it from the index when the file is missing, damaged or stale.
+func (s *segment) loadFilter() {
+	if f, err := s.readFilter(); err == nil {
+		s.filter = f
+
+		return
+	} else if !errors.Is(err, os.ErrNotExist) {
+		s.logf("can't use bloom filter of %s: %v", s.path, err)
+	}
+
+	s.buildFilter()
+}
+
+func (s *segment) readFilter() (*bloomFilter, error) {
+	data, err := ioutil.ReadFile(s.path + bloomSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 20 {
+		return nil, errInvalidBloom
+	}
+
+	body := data[:len(data)-4]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return nil, errInvalidBloom
+	}
+
+	if int64(binary.LittleEndian.Uint64(body)) != s.offset || binary.LittleEndian.Uint64(body[8:]) != s.seq {
+		return nil, errInvalidBloom
+	}
+
+	f := new(bloomFilter)
+	if err = f.Decode(body[16:]); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
@@ -0,0 +1,138 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	const keys = 1000
+
+	f := newBloomFilter(keys, bloomFalsePositiveRate)
+	for i := 0; i < keys; i++ {
+		f.add(fmt.Sprintf("key%d", i))
+	}
+
+	for i := 0; i < keys; i++ {
+		if !f.mayContain(fmt.Sprintf("key%d", i)) {
+			t.Fatalf("false negative for key%d", i)
+		}
+	}
+
+	falsePositives := 0
+
+	for i := 0; i < 10*keys; i++ {
+		if f.mayContain(fmt.Sprintf("missing%d", i)) {
+			falsePositives++
+		}
+	}
+
+	if rate := float64(falsePositives) / (10 * keys); rate > 3*bloomFalsePositiveRate {
+		t.Errorf("false positive rate %f is too high", rate)
+	}
+
+	var decoded bloomFilter
+
+	if err := decoded.Decode(f.Encode()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(&decoded, f) {
+		t.Error("decoded filter differs")
+	}
+}
+
+func TestDatastore_Bloom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, val := range bigDataset {
+		if err = db.Put(key, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, seg := range db.segments[1:] {
+		if seg.filter == nil {
+			t.Fatalf("sealed segment %s has no bloom filter", seg.path)
+		}
+
+		if _, err = os.Stat(seg.path + bloomSuffix); err != nil {
+			t.Error(err)
+		}
+	}
+
+	t.Run("stats", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			if _, err = db.Get(fmt.Sprintf("missing%d", i)); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expected %s, got %v", ErrNotFound, err)
+			}
+		}
+
+		for key := range bigDataset {
+			if _, err = db.Get(key); err != nil {
+				t.Errorf("can't get %s: %s", key, err)
+			}
+		}
+
+		stats := db.Stats()
+		if stats.BloomNegatives == 0 {
+			t.Error("bloom filters skipped no lookups")
+		}
+
+		if stats.BloomFalsePositiveRate < 0 || stats.BloomFalsePositiveRate > 0.2 {
+			t.Errorf("unexpected false positive rate %f", stats.BloomFalsePositiveRate)
+		}
+	})
+
+	t.Run("stale filter", func(t *testing.T) {
+		sealed := db.segments[len(db.segments)-1]
+		other := db.segments[1]
+
+		if err = db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// A filter of another segment must not hide keys of this one.
+		data, err := ioutil.ReadFile(other.path + bloomSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = ioutil.WriteFile(sealed.path+bloomSuffix, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if db, err = NewDatastoreMergeToSize(dir, 100, false); err != nil {
+			t.Fatal(err)
+		}
+
+		for key := range bigDataset {
+			if _, err = db.Get(key); err != nil {
+				t.Errorf("can't get %s: %s", key, err)
+			}
+		}
+	})
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
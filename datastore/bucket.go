@@ -0,0 +1,147 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// bucketMark frames the name of a bucket in front of its keys, keys of the
+// datastore itself starting with it are reserved for buckets.
+const bucketMark = "\x00"
+
+var (
+	// ErrInvalidBucket is returned for empty bucket names and names holding
+	// the bucket mark.
+	ErrInvalidBucket = errors.New("invalid bucket name")
+	// ErrReservedKey is returned for keys of the datastore itself that start
+	// with the bucket mark.
+	ErrReservedKey = errors.New("key is reserved for buckets")
+)
+
+// bucketsEnd is the smallest key greater than every key in a bucket.
+var bucketsEnd = prefixEnd(bucketMark)
+
+// Bucket is a key space of its own inside the datastore. Its keys do not
+// collide with the keys of other buckets or of the datastore, and scans of
+// the datastore leave them out.
+type Bucket struct {
+	db     *Datastore
+	name   string
+	prefix string
+}
+
+// Bucket returns the bucket with the given name. Buckets need not be
+// created, one exists as long as it holds keys.
+func (db *Datastore) Bucket(name string) (*Bucket, error) {
+	if name == "" || strings.Contains(name, bucketMark) {
+		return nil, fmt.Errorf("%w %q", ErrInvalidBucket, name)
+	}
+
+	return &Bucket{db: db, name: name, prefix: bucketMark + name + bucketMark}, nil
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+func (b *Bucket) Get(key string) ([]byte, error) {
+	return b.db.get(b.prefix + key)
+}
+
+func (b *Bucket) GetWithVersion(key string) ([]byte, uint64, error) {
+	return b.db.getWithVersion(b.prefix + key)
+}
+
+func (b *Bucket) Put(key string, value []byte) error {
+	return b.db.writeRaw(&entry{kind: entryPut, key: b.prefix + key, value: value})
+}
+
+func (b *Bucket) PutWithExpiry(key string, value []byte, expiresAt time.Time) error {
+	return b.db.writeRaw(&entry{kind: entryPut, key: b.prefix + key, value: value, expires: expiresAt.UnixNano()})
+}
+
+func (b *Bucket) Delete(key string) error {
+	return b.db.writeRaw(&entry{kind: entryDelete, key: b.prefix + key})
+}
+
+func (b *Bucket) CompareAndSwap(key string, version uint64, value []byte) error {
+	return b.db.compareAndSwap(b.prefix+key, version, value)
+}
+
+func (b *Bucket) PutIfAbsent(key string, value []byte) error {
+	return b.db.compareAndSwap(b.prefix+key, 0, value)
+}
+
+func (b *Bucket) Increment(key string, delta int64) (int64, error) {
+	return b.db.add(b.prefix+key, delta)
+}
+
+// Scan iterates over the keys of the bucket in the [start, end) range.
+func (b *Bucket) Scan(start, end string) *Iterator {
+	if end == "" {
+		end = prefixEnd(b.prefix)
+	} else {
+		end = b.prefix + end
+	}
+
+	v := b.db.pin(false)
+	defer v.release()
+
+	keys := v.keys(b.prefix+start, end)
+	for i := range keys {
+		keys[i] = keys[i][len(b.prefix):]
+	}
+
+	return &Iterator{get: b.Get, keys: keys}
+}
+
+func (b *Bucket) Prefix(p string) *Iterator {
+	return b.Scan(p, prefixEnd(p))
+}
+
+// Watch follows the changes to the keys of the bucket starting with prefix.
+func (b *Bucket) Watch(prefix string, from uint64) *Watcher {
+	return b.db.watch(b.prefix, prefix, from)
+}
+
+// Drop deletes every key of the bucket in a single batch. Keys written to
+// the bucket while it is dropped may be left.
+func (b *Bucket) Drop() error {
+	var batch WriteBatch
+
+	it := b.Scan("", "")
+	for it.Next() {
+		batch.Delete(b.prefix + it.Key())
+	}
+
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	return b.db.writeRaw(batch.entries...)
+}
+
+// checkKey rejects keys of the datastore that would reach into buckets.
+func checkKey(key string) error {
+	if strings.HasPrefix(key, bucketMark) {
+		return fmt.Errorf("%w: %q", ErrReservedKey, key)
+	}
+
+	return nil
+}
+
+// withoutBuckets moves the start of a scan of the datastore past the keys of
+// buckets.
+func withoutBuckets(start string) string {
+	if start < bucketsEnd {
+		return bucketsEnd
+	}
+
+	return start
+}
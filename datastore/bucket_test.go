@@ -0,0 +1,231 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDatastore_Bucket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 200, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(db *Datastore) {
+		_ = db.Close()
+	}(db)
+
+	for _, name := range []string{"", "a\x00b"} {
+		if _, err = db.Bucket(name); !errors.Is(err, ErrInvalidBucket) {
+			t.Errorf("expected %s for %q, got %v", ErrInvalidBucket, name, err)
+		}
+	}
+
+	users, err := db.Bucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orders, err := db.Bucket("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pairs := []struct {
+		put   func(key string, value []byte) error
+		key   string
+		value string
+	}{
+		{db.Put, "1", "plain"},
+		{users.Put, "1", "alice"},
+		{users.Put, "2", "bob"},
+		{orders.Put, "1", "book"},
+	}
+
+	for _, pair := range pairs {
+		if err = pair.put(pair.key, []byte(pair.value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := func(it *Iterator) []string {
+		var keys []string
+
+		for it.Next() {
+			keys = append(keys, it.Key()+"="+string(it.Value()))
+		}
+
+		return keys
+	}
+
+	t.Run("isolated", func(t *testing.T) {
+		for _, pair := range []struct {
+			get   func(key string) ([]byte, error)
+			value string
+		}{
+			{db.Get, "plain"},
+			{users.Get, "alice"},
+			{orders.Get, "book"},
+		} {
+			if value, err := pair.get("1"); err != nil || string(value) != pair.value {
+				t.Errorf("expected %s, got %s, %v", pair.value, value, err)
+			}
+		}
+
+		if _, err = orders.Get("2"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected %s, got %v", ErrNotFound, err)
+		}
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		if got, want := keys(users.Scan("", "")), []string{"1=alice", "2=bob"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+
+		if got, want := keys(db.Scan("", "")), []string{"1=plain"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		w := users.Watch("", db.Seq())
+		defer w.Close()
+
+		if err = orders.Put("3", []byte("pen")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = users.Put("3", []byte("carol")); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case event := <-w.Events():
+			if event.Key != "3" || string(event.Value) != "carol" {
+				t.Errorf("unexpected event %+v", event)
+			}
+		case <-time.After(time.Second):
+			t.Error("no event")
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		if err = users.Drop(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := keys(users.Scan("", "")); len(got) != 0 {
+			t.Errorf("dropped bucket holds %v", got)
+		}
+
+		if got, want := keys(orders.Scan("", "")), []string{"1=book", "3=pen"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+}
+
+func TestDatastore_ReservedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 200, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(db *Datastore) {
+		_ = db.Close()
+	}(db)
+
+	team, err := db.Bucket("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = team.Put("secret", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	key := "\x00team\x00secret"
+
+	var batch WriteBatch
+
+	batch.Put(key, []byte("other"))
+
+	snapshot := db.Snapshot()
+	defer snapshot.Release()
+
+	for name, op := range map[string]func() error{
+		"get": func() error {
+			_, err := db.Get(key)
+
+			return err
+		},
+		"get with version": func() error {
+			_, _, err := db.GetWithVersion(key)
+
+			return err
+		},
+		"snapshot get": func() error {
+			_, err := snapshot.Get(key)
+
+			return err
+		},
+		"put":             func() error { return db.Put(key, []byte("other")) },
+		"put with expiry": func() error { return db.PutWithExpiry(key, []byte("other"), time.Now().Add(time.Hour)) },
+		"delete":          func() error { return db.Delete(key) },
+		"compare and swap": func() error {
+			return db.CompareAndSwap(key, 1, []byte("other"))
+		},
+		"put if absent": func() error { return db.PutIfAbsent("\x00team\x00other", []byte("other")) },
+		"increment": func() error {
+			_, err := db.Increment(key, 1)
+
+			return err
+		},
+		"write": func() error { return db.Write(&batch) },
+	} {
+		if err := op(); !errors.Is(err, ErrReservedKey) {
+			t.Errorf("%s: expected %s, got %v", name, ErrReservedKey, err)
+		}
+	}
+
+	if value, err := team.Get("secret"); err != nil || string(value) != "value" {
+		t.Errorf("bucket value changed: %s, %v", value, err)
+	}
+
+	var keys []string
+
+	for it := team.Scan("", ""); it.Next(); {
+		keys = append(keys, it.Key())
+	}
+
+	if !reflect.DeepEqual(keys, []string{"secret"}) {
+		t.Errorf("unexpected keys in the bucket: %q", keys)
+	}
+}
@@ -0,0 +1,166 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Checkpoint writes a consistent copy of the datastore to dir, which must not
+// exist or be empty. Sealed segments are hard linked when dir is on the same
+// file system and copied otherwise, the active segment is copied up to the
+// last write made before the call. Writes and merges go on meanwhile.
+func (db *Datastore) Checkpoint(dir string) error {
+	if err := emptyDir(dir); err != nil {
+		return err
+	}
+
+	v := db.pin(false)
+	defer v.release()
+
+	// Whatever is written to the pinned active segment up to the moment it is
+	// opened belongs to the checkpoint. It may be sealed and renamed while it
+	// is copied, the opened file stays the same.
+	db.mutex.RLock()
+	size := v.segments[0].offset
+	active, err := os.Open(v.segments[0].path)
+	db.mutex.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(active)
+
+	if err = copyFile(io.LimitReader(active, size), filepath.Join(dir, segmentPrefix+currentSegmentSuffix)); err != nil {
+		return fmt.Errorf("can't copy active segment: %w", err)
+	}
+
+	for _, seg := range v.segments[1:] {
+		target := filepath.Join(dir, filepath.Base(seg.path))
+
+		if err = linkOrCopy(seg.path, target); err != nil {
+			return fmt.Errorf("can't copy %s: %w", seg.path, err)
+		}
+
+		// Hint and filter files are only an optimisation, restore rebuilds
+		// them if they are missing.
+		for _, suffix := range []string{hintSuffix, bloomSuffix} {
+			if err = linkOrCopy(seg.path+suffix, target+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("can't copy %s: %w", seg.path+suffix, err)
+			}
+		}
+	}
+
+	return syncDir(dir)
+}
+
+// Restore fills dir, which must not exist or be empty, with the segments of a
+// checkpoint, leaving the checkpoint itself untouched. The datastore can then
+// be opened in dir.
+func Restore(checkpoint, dir string) error {
+	files, err := ioutil.ReadDir(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	if err = emptyDir(dir); err != nil {
+		return err
+	}
+
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), segmentPrefix) {
+			continue
+		}
+
+		src, err := os.Open(filepath.Join(checkpoint, fi.Name()))
+		if err != nil {
+			return err
+		}
+
+		err = copyFile(src, filepath.Join(dir, fi.Name()))
+		_ = src.Close()
+
+		if err != nil {
+			return fmt.Errorf("can't restore %s: %w", fi.Name(), err)
+		}
+	}
+
+	return syncDir(dir)
+}
+
+// emptyDir creates dir unless it exists and fails if it holds any files.
+func emptyDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	if len(files) > 0 {
+		return fmt.Errorf("%s is not empty", dir)
+	}
+
+	return nil
+}
+
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil || errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	return copyFile(f, dst)
+}
+
+// copyFile writes everything read from src to a new file at dst and syncs it.
+func copyFile(src io.Reader, dst string) error {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, src); err != nil {
+		_ = f.Close()
+
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+
+		return err
+	}
+
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	defer func(d *os.File) {
+		_ = d.Close()
+	}(d)
+
+	return d.Sync()
+}
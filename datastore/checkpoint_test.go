@@ -0,0 +1,123 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestDatastore_Checkpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	if err = os.Mkdir(filepath.Join(dir, "db"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDatastoreMergeToSize(filepath.Join(dir, "db"), 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, val := range bigDataset {
+		if err = db.Put(key, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint := filepath.Join(dir, "checkpoint")
+
+	t.Run("checkpoint", func(t *testing.T) {
+		// Writes, sealing and merges keep going while the checkpoint is made.
+		var wg sync.WaitGroup
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 100; i++ {
+				if err := db.Put(fmt.Sprintf("later%d", i), []byte("value")); err != nil {
+					t.Error(err)
+
+					return
+				}
+			}
+		}()
+
+		if err = db.Checkpoint(checkpoint); err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Wait()
+
+		if err = db.Checkpoint(checkpoint); err == nil {
+			t.Error("checkpoint overwrote an existing one")
+		}
+	})
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("restore", func(t *testing.T) {
+		restored := filepath.Join(dir, "restored")
+
+		if err = Restore(checkpoint, restored); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := NewDatastoreMergeToSize(restored, 100, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer func(db *Datastore) {
+			_ = db.Close()
+		}(db)
+
+		for key, val := range bigDataset {
+			value, err := db.Get(key)
+			if key == "key1" {
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("expected %s for deleted key1, got %v", ErrNotFound, err)
+				}
+
+				continue
+			}
+
+			if err != nil || string(value) != string(val) {
+				t.Errorf("can't get %s: %s, %v", key, value, err)
+			}
+		}
+
+		// Later writes are either all there up to some point or missing.
+		missing := false
+
+		for i := 0; i < 100; i++ {
+			_, err := db.Get(fmt.Sprintf("later%d", i))
+			if errors.Is(err, ErrNotFound) {
+				missing = true
+			} else if err != nil || missing {
+				t.Fatalf("checkpoint is inconsistent at later%d: %v", i, err)
+			}
+		}
+	})
+}
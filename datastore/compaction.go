@@ -0,0 +1,177 @@
+package datastore
+
+// SegmentStats describes a sealed segment to a compaction policy. Stats
+// reports the active segment as well, with an ID of -1.
+type SegmentStats struct {
+	ID   int
+	Size int64
+	// LiveBytes is the size of records still holding the latest write of
+	// their key. Expired records count as live until they are merged.
+	LiveBytes int64
+}
+
+// Garbage returns the share of the segment taken by overwritten records.
+func (s SegmentStats) Garbage() float64 {
+	if s.Size == 0 {
+		return 0
+	}
+
+	return float64(s.Size-s.LiveBytes) / float64(s.Size)
+}
+
+// CompactionPolicy decides which sealed segments are merged together. Select
+// gets them ordered from the newest to the oldest and returns the bounds of
+// a run of adjacent segments to merge, an empty run means nothing to do.
+// Segments are never merged with anything but their neighbours, so that
+// the merged one can take their place in the lookup order. Records only the
+// active segment overwrote are reported live, merges can't drop them yet.
+type CompactionPolicy interface {
+	Select(segments []SegmentStats) (from, to int)
+}
+
+// MergeAll merges all sealed segments into one as soon as there are two.
+type MergeAll struct{}
+
+func (MergeAll) Select(segments []SegmentStats) (int, int) {
+	if len(segments) < 2 {
+		return 0, 0
+	}
+
+	return 0, len(segments)
+}
+
+// SizeTiered merges runs of at least MinSegments adjacent segments whose
+// sizes are within Ratio of the smallest one, so that every record is
+// rewritten a logarithmic number of times.
+type SizeTiered struct {
+	MinSegments int
+	Ratio       float64
+}
+
+func (p SizeTiered) Select(segments []SegmentStats) (int, int) {
+	for from := 0; from < len(segments); {
+		to, smallest := from+1, segments[from].Size
+
+		for ; to < len(segments); to++ {
+			size := segments[to].Size
+			if float64(size) > p.Ratio*float64(smallest) || float64(smallest) > p.Ratio*float64(size) {
+				break
+			}
+
+			if size < smallest {
+				smallest = size
+			}
+		}
+
+		if to-from >= p.MinSegments {
+			return from, to
+		}
+
+		from = to
+	}
+
+	return 0, 0
+}
+
+// GarbageRatio rewrites the segment with the most garbage once overwritten
+// records take more than Threshold of it, together with the adjacent
+// segments above the threshold.
+type GarbageRatio struct {
+	Threshold float64
+}
+
+func (p GarbageRatio) Select(segments []SegmentStats) (int, int) {
+	worst := -1
+
+	for i, s := range segments {
+		if s.Garbage() > p.Threshold && (worst < 0 || s.Garbage() > segments[worst].Garbage()) {
+			worst = i
+		}
+	}
+
+	if worst < 0 {
+		return 0, 0
+	}
+
+	from, to := worst, worst+1
+
+	for from > 0 && segments[from-1].Garbage() > p.Threshold {
+		from--
+	}
+
+	for to < len(segments) && segments[to].Garbage() > p.Threshold {
+		to++
+	}
+
+	return from, to
+}
+
+// SetCompactionPolicy replaces the policy run after writes, nil turns
+// compaction off.
+func (db *Datastore) SetCompactionPolicy(p CompactionPolicy) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.compaction = p
+}
+
+// segmentStats returns the sealed segments together with their stats.
+// Records only the active segment overwrote count as live, since merges keep
+// them until it is sealed and a rewrite would leave the garbage as it was.
+func (db *Datastore) segmentStats() ([]*segment, []SegmentStats) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	sealed := make([]*segment, len(db.segments)-1)
+	stats := make([]SegmentStats, len(sealed))
+
+	copy(sealed, db.segments[1:])
+
+	for i, s := range sealed {
+		stats[i] = SegmentStats{ID: s.id(), Size: s.offset, LiveBytes: s.live}
+	}
+
+	for key := range db.segments[0].index {
+		for i, s := range sealed {
+			if pos, ok := s.index[key]; ok {
+				stats[i].LiveBytes += pos.size
+
+				break
+			}
+		}
+	}
+
+	return sealed, stats
+}
+
+// compact merges the runs picked by the policy until it is satisfied. Every
+// merge shrinks the number of segments or their garbage, so the loop is
+// bounded by the number of segments for any sensible policy.
+func (db *Datastore) compact() {
+	db.mutex.RLock()
+	rounds := len(db.segments)
+	db.mutex.RUnlock()
+
+	for ; rounds > 0; rounds-- {
+		db.mutex.RLock()
+		p := db.compaction
+		db.mutex.RUnlock()
+
+		if p == nil {
+			return
+		}
+
+		sealed, stats := db.segmentStats()
+
+		from, to := p.Select(stats)
+		if from < 0 || to > len(stats) || from >= to {
+			return
+		}
+
+		if err := db.mergeSegments(sealed[from:to]); err != nil {
+			db.logger.Printf("can't compact segments: %v", err)
+
+			return
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCompactionPolicy_Select(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		policy   CompactionPolicy
+		segments []SegmentStats
+		from, to int
+	}{
+		{"merge all", MergeAll{}, []SegmentStats{{Size: 10}, {Size: 20}}, 0, 2},
+		{"merge all single", MergeAll{}, []SegmentStats{{Size: 10}}, 0, 0},
+		{
+			"size tiered",
+			SizeTiered{MinSegments: 3, Ratio: 2},
+			[]SegmentStats{{Size: 10}, {Size: 100}, {Size: 120}, {Size: 90}, {Size: 1000}},
+			1, 4,
+		},
+		{
+			"size tiered short runs",
+			SizeTiered{MinSegments: 3, Ratio: 2},
+			[]SegmentStats{{Size: 10}, {Size: 100}, {Size: 120}, {Size: 1000}},
+			0, 0,
+		},
+		{
+			"garbage ratio",
+			GarbageRatio{Threshold: 0.5},
+			[]SegmentStats{
+				{Size: 100, LiveBytes: 100},
+				{Size: 100, LiveBytes: 40},
+				{Size: 100, LiveBytes: 10},
+				{Size: 100, LiveBytes: 90},
+				{Size: 100, LiveBytes: 80},
+			},
+			1, 3,
+		},
+		{
+			"garbage ratio below threshold",
+			GarbageRatio{Threshold: 0.5},
+			[]SegmentStats{{Size: 100, LiveBytes: 60}, {Size: 100, LiveBytes: 100}},
+			0, 0,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			from, to := tc.policy.Select(tc.segments)
+			if from != tc.from || to != tc.to {
+				t.Errorf("selected [%d, %d), want [%d, %d)", from, to, tc.from, tc.to)
+			}
+		})
+	}
+}
+
+func TestDatastore_GarbageRatio(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 10000, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Three segments: the oldest one keeps its values, the middle one is
+	// almost entirely overwritten and deletes a key of the oldest one.
+	for i := 0; i < 8; i++ {
+		if err = db.Put(fmt.Sprintf("old%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = db.addSegment(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 8; i++ {
+		if err = db.Put(fmt.Sprintf("hot%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = db.Delete("old0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.addSegment(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 8; i++ {
+		if err = db.Put(fmt.Sprintf("hot%d", i), []byte("fresh")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = db.addSegment(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, stats := db.segmentStats()
+	if len(stats) != 3 {
+		t.Fatalf("got %d sealed segments, want 3", len(stats))
+	}
+
+	t.Run("live bytes", func(t *testing.T) {
+		if stats[0].Garbage() != 0 || stats[1].Garbage() < 0.5 || stats[2].Garbage() > 0.5 {
+			t.Errorf("unexpected garbage ratios: %v", stats)
+		}
+
+		if err = db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if db, err = NewDatastoreMergeToSize(dir, 10000, false); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, reopened := db.segmentStats(); !reflect.DeepEqual(reopened, stats) {
+			t.Errorf("stats differ after reopening: %v, want %v", reopened, stats)
+		}
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		db.SetCompactionPolicy(GarbageRatio{Threshold: 0.5})
+		db.compact()
+
+		_, compacted := db.segmentStats()
+		if len(compacted) != 3 || compacted[0] != stats[0] || compacted[2] != stats[2] {
+			t.Fatalf("unexpected segments after compaction: %v", compacted)
+		}
+
+		if compacted[1].Garbage() != 0 || compacted[1].Size >= stats[1].Size {
+			t.Errorf("middle segment was not rewritten: %v", compacted[1])
+		}
+
+		// The tombstone still hides the value kept by the oldest segment.
+		if _, err = db.Get("old0"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected %s, got %v", ErrNotFound, err)
+		}
+
+		for i := 1; i < 8; i++ {
+			if value, err := db.Get(fmt.Sprintf("old%d", i)); err != nil || string(value) != "value" {
+				t.Errorf("can't get old%d: %s, %v", i, value, err)
+			}
+
+			if value, err := db.Get(fmt.Sprintf("hot%d", i)); err != nil || string(value) != "fresh" {
+				t.Errorf("can't get hot%d: %s, %v", i, value, err)
+			}
+		}
+	})
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDatastore_GarbageRatioActive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 10000, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(db *Datastore) {
+		_ = db.Close()
+	}(db)
+
+	for i := 0; i < 5; i++ {
+		if err = db.Put(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = db.addSegment(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The overwrites stay in the active segment.
+	for i := 0; i < 3; i++ {
+		if err = db.Put(fmt.Sprintf("key%d", i), []byte("fresh")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db.SetCompactionPolicy(GarbageRatio{Threshold: 0.5})
+
+	for i := 0; i < 20; i++ {
+		if err = db.Put(fmt.Sprintf("other%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Merging would keep the overwritten records, there is nothing to gain
+	// until the active segment is sealed.
+	db.compact()
+
+	if merges := atomic.LoadInt64(&db.merges); merges != 0 {
+		t.Errorf("got %d merges while the overwrites are active, want 0", merges)
+	}
+
+	if _, err = db.addSegment(); err != nil {
+		t.Fatal(err)
+	}
+
+	db.compact()
+
+	if merges := atomic.LoadInt64(&db.merges); merges != 1 {
+		t.Errorf("got %d merges after sealing, want 1", merges)
+	}
+
+	_, stats := db.segmentStats()
+	if len(stats) != 2 || stats[0].Garbage() != 0 || stats[1].Garbage() != 0 {
+		t.Errorf("unexpected segments after compaction: %v", stats)
+	}
+
+	for i := 0; i < 5; i++ {
+		want := "value"
+		if i < 3 {
+			want = "fresh"
+		}
+
+		if value, err := db.Get(fmt.Sprintf("key%d", i)); err != nil || string(value) != want {
+			t.Errorf("can't get key%d: %s, %v", i, value, err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Codec is the compression of values in a segment.
+type Codec string
+
+const (
+	NoCompression Codec = ""
+	Gzip          Codec = "gzip"
+)
+
+// ErrUnknownCodec is returned for segments compressed with a codec this
+// version does not support.
+var ErrUnknownCodec = errors.New("unknown compression codec")
+
+// SetCompression sets the codec new segments are compressed with. Like a key
+// rotation it takes effect with a new active segment, and merges recompress
+// older segments into it.
+func (db *Datastore) SetCompression(codec Codec) error {
+	if codec != NoCompression && codec != Gzip {
+		return fmt.Errorf("%w %q", ErrUnknownCodec, codec)
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.compression = codec
+
+	return nil
+}
+
+func compress(codec Codec, value []byte) ([]byte, error) {
+	if codec != Gzip {
+		return nil, fmt.Errorf("%w %q", ErrUnknownCodec, codec)
+	}
+
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decompress(codec Codec, key string, value []byte) ([]byte, error) {
+	if codec != Gzip {
+		return nil, fmt.Errorf("%w %q", ErrUnknownCodec, codec)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, fmt.Errorf("%w: can't decompress value of %s", ErrCorruptedFile, key)
+	}
+
+	plain, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: can't decompress value of %s", ErrCorruptedFile, key)
+	}
+
+	return plain, nil
+}
@@ -0,0 +1,106 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDatastore_Compression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 1000, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := func(i int) string {
+		return fmt.Sprintf(`{"id":%d,"tags":["%s"]}`, i, strings.Repeat("compressible", 20))
+	}
+
+	put := func(t *testing.T, from, to int) {
+		t.Helper()
+
+		for i := from; i < to; i++ {
+			if err = db.Put(fmt.Sprintf("key%d", i), []byte(value(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	check := func(t *testing.T, n int) {
+		t.Helper()
+
+		for i := 0; i < n; i++ {
+			got, err := db.Get(fmt.Sprintf("key%d", i))
+			if err != nil || string(got) != value(i) {
+				t.Errorf("can't get key%d: %s, %v", i, got, err)
+			}
+		}
+	}
+
+	// The first segment is written before compression is turned on.
+	put(t, 0, 4)
+
+	if err = db.SetCompression("zstd"); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("expected %s, got %v", ErrUnknownCodec, err)
+	}
+
+	if err = db.SetCompression(Gzip); err != nil {
+		t.Fatal(err)
+	}
+
+	put(t, 4, 20)
+
+	t.Run("smaller", func(t *testing.T) {
+		active := db.segments[0]
+		if size := active.index["key19"].size; active.format.codec != Gzip || size > int64(len(value(19))) {
+			t.Errorf("record of %d bytes in a segment in %+v", size, active.format)
+		}
+
+		check(t, 20)
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		if err = db.merge(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, s := range db.segments {
+			if s.format.codec != Gzip {
+				t.Errorf("%s is not recompressed", s.path)
+			}
+		}
+
+		check(t, 20)
+	})
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("reopen", func(t *testing.T) {
+		if db, err = NewDatastoreMergeToSize(dir, 1000, false); err != nil {
+			t.Fatal(err)
+		}
+
+		defer func(db *Datastore) {
+			_ = db.Close()
+		}(db)
+
+		check(t, 20)
+	})
+}
@@ -7,12 +7,15 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/sync/semaphore"
 )
@@ -23,33 +26,90 @@ const (
 )
 
 var (
-	ErrNotFound      = errors.New("entry does not exist")
-	ErrCorruptedFile = errors.New("corrupted file")
+	ErrNotFound        = errors.New("entry does not exist")
+	ErrCorruptedFile   = errors.New("corrupted file")
+	ErrVersionConflict = errors.New("version conflict")
+	ErrNotInteger      = errors.New("value is not an integer")
+	ErrOverflow        = errors.New("integer overflow")
+
+	errDeleted = fmt.Errorf("%w: deleted", ErrNotFound)
 )
 
-type hashIndex map[string]int64
+// position locates the latest record of a key in a segment.
+type position struct {
+	offset int64
+	size   int64
+}
+
+type hashIndex map[string]position
 
 type putQuery struct {
-	entry    *entry
-	callback chan error
+	entries []*entry
+	// expected is the version the key of a conditional write must have.
+	expected *uint64
+	// delta is added to the number the key holds to get the written value.
+	delta *int64
+	// replicated entries keep their sequence numbers and versions, the
+	// sequence number is then brought up to seq. A reset drops all data
+	// first.
+	replicated bool
+	reset      bool
+	seq        uint64
+	callback   chan error
 }
 
 type Datastore struct {
 	mutex     *sync.RWMutex
 	semaphore *semaphore.Weighted
 	out       *os.File
+	files     *fileCache
+	lock      *os.File
+	logger    Logger
+	// readOnly datastores have no output file and fail every write.
+	readOnly bool
 
 	dir              string
 	currentBlockSize int64
-	mergingPolicy    bool
-
-	segments       []*segment
+	compaction       CompactionPolicy
+
+	segments []*segment
+	seq      uint64
+	// changed is closed and replaced on every write.
+	changed chan struct{}
+	// horizon is the highest sequence number of a record dropped by merge
+	// that Changes can no longer return.
+	horizon uint64
+	// floor is the highest version of a key dropped by merge, versions of
+	// keys written afresh start above it.
+	floor          uint64
+	nextID         int
 	mergingChannel chan int
-	putChannel     chan putQuery
+	mergingDone    chan struct{}
+	mergeMutex     sync.Mutex
+
+	compactionLimiter rateLimiter
+	putChannel        chan putQuery
+	keyring           *Keyring
+	compression       Codec
+
+	syncMutex    sync.Mutex
+	syncMode     SyncMode
+	syncInterval time.Duration
+	syncDone     chan struct{}
+	syncs        int64
+
+	bloomNegatives      int64
+	bloomFalsePositives int64
+
+	merges        int64
+	mergeTime     int64
+	lastMergeTime int64
+	putQueue      int64
+	semaphoreWait int64
 }
 
 func NewDatastore(dir string) (*Datastore, error) {
-	return NewDatastoreMergeToSize(dir, maxBlockSize, true)
+	return Open(dir)
 }
 
 func NewDatastoreMerge(dir string, mergingPolicy bool) (*Datastore, error) {
@@ -57,209 +117,719 @@ func NewDatastoreMerge(dir string, mergingPolicy bool) (*Datastore, error) {
 }
 
 func NewDatastoreOfSize(dir string, currentBlockSize int64) (*Datastore, error) {
-	return NewDatastoreMergeToSize(dir, currentBlockSize, true)
+	return Open(dir, WithSegmentSize(currentBlockSize))
 }
 
 func NewDatastoreMergeToSize(dir string, currentBlockSize int64, mergingPolicy bool) (*Datastore, error) {
-	outputPath := filepath.Join(dir, segmentPrefix+currentSegmentSuffix)
+	var compaction CompactionPolicy
+	if mergingPolicy {
+		compaction = MergeAll{}
+	}
 
-	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	return Open(dir, WithSegmentSize(currentBlockSize), WithCompactionPolicy(compaction))
+}
+
+// Open opens the datastore kept in dir, creating it if the directory is
+// empty. Options are validated before any file is touched.
+func Open(dir string, opts ...Option) (*Datastore, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if err := o.validate(); err != nil {
+		return nil, fmt.Errorf("invalid options: %w", err)
+	}
+
+	lock, err := lockDir(dir, o.readOnly)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("can't lock %s: %w", dir, err)
+	}
+
+	outputPath := filepath.Join(dir, segmentPrefix+currentSegmentSuffix)
+
+	var f *os.File
+
+	if !o.readOnly {
+		if f, err = os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600); err != nil {
+			_ = unlockDir(lock)
+
+			return nil, err
+		}
+	}
+
+	closeOutput := func() {
+		if f != nil {
+			_ = f.Close()
+		}
+
+		_ = unlockDir(lock)
 	}
 
 	var segments []*segment
 
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
+		closeOutput()
+
 		return nil, err
 	}
 
+	var (
+		seq    uint64
+		nextID int
+	)
+
 	for _, fileInfo := range files {
-		if strings.HasPrefix(fileInfo.Name(), segmentPrefix) {
-			s := &segment{
-				path:  filepath.Join(dir, fileInfo.Name()),
-				index: make(hashIndex),
-			}
+		if !strings.HasPrefix(fileInfo.Name(), segmentPrefix) {
+			continue
+		}
+
+		s := &segment{
+			path:     filepath.Join(dir, fileInfo.Name()),
+			index:    make(hashIndex),
+			logger:   o.logger,
+			readOnly: o.readOnly,
+		}
 
-			if err = s.restore(); !errors.Is(err, io.EOF) {
-				return nil, err
+		// Anything but the active and sealed segments is a leftover of an
+		// interrupted merge.
+		switch {
+		case s.suffix() == currentSegmentSuffix && o.readOnly:
+			// The torn record is left for the next writable open to drop.
+			if err = s.restore(); errors.Is(err, ErrCorruptedFile) {
+				if _, err = s.torn(); err == nil {
+					o.logger.Printf("ignoring %s after offset %d: torn record", s.path, s.offset)
+
+					err = io.EOF
+				}
 			}
+		case s.suffix() == currentSegmentSuffix:
+			err = s.recover()
+		case s.id() >= 0:
+			err = s.load()
+		default:
+			continue
+		}
+
+		if !errors.Is(err, io.EOF) {
+			closeOutput()
 
-			segments = append(segments, s)
+			return nil, err
 		}
-	}
 
-	sort.Slice(segments, func(n, m int) bool {
-		suffixFirst := segments[n].path[len(dir+segmentPrefix)+1:]
-		suffixSecond := segments[m].path[len(dir+segmentPrefix)+1:]
+		if s.id() >= 0 {
+			s.loadFilter()
+		}
 
-		if suffixFirst == currentSegmentSuffix || suffixSecond == mergedSegmentSuffix {
-			return true
+		if s.seq > seq {
+			seq = s.seq
 		}
 
-		if suffixSecond == currentSegmentSuffix || suffixFirst == mergedSegmentSuffix {
-			return false
+		// Merge may have dropped the latest write, a delete.
+		if s.horizon > seq {
+			seq = s.horizon
 		}
 
-		suffixN, errN := strconv.Atoi(suffixFirst)
-		suffixM, errM := strconv.Atoi(suffixSecond)
+		if s.id() >= nextID {
+			nextID = s.id() + 1
+		}
 
-		return errM != nil || (errN != nil && suffixN > suffixM)
+		segments = append(segments, s)
+	}
+
+	if f == nil && (len(segments) == 0 || segments[0].suffix() != currentSegmentSuffix) {
+		segments = append(segments, &segment{path: outputPath, index: make(hashIndex), logger: o.logger, readOnly: true})
+	}
+
+	sort.Slice(segments, func(n, m int) bool {
+		return segments[n].newerThan(segments[m])
 	})
 
-	mergingChannel := make(chan int)
+	countLive(segments)
+
+	// The records merges dropped may have had the highest sequence numbers.
+	var horizon, floor uint64
+
+	for _, s := range segments {
+		if s.horizon > horizon {
+			horizon = s.horizon
+		}
+
+		if s.floor > floor {
+			floor = s.floor
+		}
+	}
+
+	// A pending request to compact is enough for any number of writes.
+	mergingChannel := make(chan int, 1)
 	putChannel := make(chan putQuery)
 
 	db := &Datastore{
 		mutex:            new(sync.RWMutex),
-		semaphore:        semaphore.NewWeighted(maxReadThreads),
+		semaphore:        semaphore.NewWeighted(o.readConcurrency),
 		out:              f,
+		files:            newFileCache(maxOpenFiles),
+		lock:             lock,
+		logger:           o.logger,
+		readOnly:         o.readOnly,
 		dir:              dir,
-		currentBlockSize: currentBlockSize,
-		mergingPolicy:    mergingPolicy,
+		currentBlockSize: o.segmentSize,
+		compaction:       o.compaction,
 		segments:         segments,
+		seq:              seq,
+		changed:          make(chan struct{}),
+		horizon:          horizon,
+		floor:            floor,
+		nextID:           nextID,
 		mergingChannel:   mergingChannel,
+		mergingDone:      make(chan struct{}),
 		putChannel:       putChannel,
 	}
 
 	go func() {
+		defer close(db.mergingDone)
+
 		for el := range mergingChannel {
 			if el == 0 {
 				return
 			}
 
-			_ = db.merge()
+			db.compact()
 		}
 	}()
 
 	go func() {
 		for el := range putChannel {
-			if el.entry == nil {
+			if el.entries == nil {
 				return
 			}
 
-			_ = db.put(el)
+			batch, closing := db.drain([]putQuery{el})
+
+			_ = db.put(batch)
+
+			if closing {
+				return
+			}
 		}
 	}()
 
+	if o.syncMode != SyncNever {
+		if err = db.SetSyncMode(o.syncMode, o.syncInterval); err != nil {
+			_ = db.Close()
+
+			return nil, err
+		}
+	}
+
 	return db, nil
 }
 
 func (db *Datastore) Close() error {
+	db.compactionLimiter.close()
 	db.mergingChannel <- 0
-	db.putChannel <- putQuery{entry: nil}
+	<-db.mergingDone
+	db.putChannel <- putQuery{entries: nil}
+
+	db.stopSyncing()
+	db.files.resize(0)
+
+	// The lock goes last, once nothing is written to the directory.
+	defer func(lock *os.File) {
+		if err := unlockDir(lock); err != nil {
+			db.logger.Printf("can't unlock %s: %v", db.dir, err)
+		}
+	}(db.lock)
+
+	if db.out == nil {
+		return nil
+	}
+
+	if mode, _ := db.SyncMode(); mode != SyncNever {
+		if err := db.out.Sync(); err != nil {
+			return err
+		}
+	}
 
 	return db.out.Close()
 }
 
 func (db *Datastore) Get(key string) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	return db.get(key)
+}
+
+func (db *Datastore) get(key string) ([]byte, error) {
 	// We use semaphore to accomplish 3rd task cause it gives
 	// better performance than method suggested in task and it's easier
-	if err := db.semaphore.Acquire(context.TODO(), 1); err != nil {
+	if err := db.acquire(); err != nil {
 		return nil, err
 	}
 
 	defer db.semaphore.Release(1)
 
-	var (
-		value []byte
-		err   error
-	)
+	v := db.pin(false)
+	defer v.release()
 
-	for _, seg := range db.segments {
-		if value, err = seg.get(key); err == nil {
-			return value, nil
-		}
+	return v.get(key)
+}
+
+// GetWithVersion returns the value of a key together with its version, which
+// grows by one with every write of the key.
+func (db *Datastore) GetWithVersion(key string) ([]byte, uint64, error) {
+	if err := checkKey(key); err != nil {
+		return nil, 0, err
+	}
+
+	return db.getWithVersion(key)
+}
+
+func (db *Datastore) getWithVersion(key string) ([]byte, uint64, error) {
+	if err := db.acquire(); err != nil {
+		return nil, 0, err
 	}
 
-	return nil, err
+	defer db.semaphore.Release(1)
+
+	v := db.pin(false)
+	defer v.release()
+
+	return v.getWithVersion(key)
+}
+
+// acquire takes one of the read slots, accounting for the time spent waiting
+// for it. Every acquired slot has to be released.
+func (db *Datastore) acquire() error {
+	start := time.Now()
+	err := db.semaphore.Acquire(context.TODO(), 1)
+
+	atomic.AddInt64(&db.semaphoreWait, int64(time.Since(start)))
+
+	return err
 }
 
 func (db *Datastore) Put(key string, value []byte) error {
-	callback := make(chan error)
-	e := &entry{key: key, value: value}
+	return db.write(&entry{kind: entryPut, key: key, value: value})
+}
+
+// PutWithExpiry stores a value that reads as missing from expiresAt on.
+func (db *Datastore) PutWithExpiry(key string, value []byte, expiresAt time.Time) error {
+	return db.write(&entry{kind: entryPut, key: key, value: value, expires: expiresAt.UnixNano()})
+}
+
+func (db *Datastore) Delete(key string) error {
+	return db.write(&entry{kind: entryDelete, key: key})
+}
+
+// CompareAndSwap stores a value only if the key is still at the given
+// version, returning ErrVersionConflict otherwise. Missing keys are at
+// version zero.
+func (db *Datastore) CompareAndSwap(key string, version uint64, value []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	return db.compareAndSwap(key, version, value)
+}
+
+func (db *Datastore) compareAndSwap(key string, version uint64, value []byte) error {
+	return db.submit(putQuery{
+		entries:  []*entry{{kind: entryPut, key: key, value: value}},
+		expected: &version,
+	})
+}
+
+// PutIfAbsent stores a value unless the key already holds one.
+func (db *Datastore) PutIfAbsent(key string, value []byte) error {
+	return db.CompareAndSwap(key, 0, value)
+}
+
+// Increment adds delta to the decimal integer stored under a key, treating a
+// missing key as zero, and returns the new value. The value written is not
+// set to expire even if the previous one was.
+func (db *Datastore) Increment(key string, delta int64) (int64, error) {
+	if err := checkKey(key); err != nil {
+		return 0, err
+	}
+
+	return db.add(key, delta)
+}
+
+func (db *Datastore) add(key string, delta int64) (int64, error) {
+	e := &entry{kind: entryPut, key: key}
+
+	if err := db.submit(putQuery{entries: []*entry{e}, delta: &delta}); err != nil {
+		return 0, err
+	}
 
-	db.putChannel <- putQuery{entry: e, callback: callback}
+	return strconv.ParseInt(string(e.value), 10, 64)
+}
+
+// write checks that the keys of the entries are not reserved for buckets,
+// buckets themselves use writeRaw.
+func (db *Datastore) write(entries ...*entry) error {
+	for _, e := range entries {
+		if err := checkKey(e.key); err != nil {
+			return err
+		}
+	}
 
-	res := <-callback
+	return db.writeRaw(entries...)
+}
 
-	return res
+func (db *Datastore) writeRaw(entries ...*entry) error {
+	return db.submit(putQuery{entries: entries})
 }
 
-func (db *Datastore) put(pe putQuery) error {
-	if len(db.segments) > 2 && db.mergingPolicy {
-		go func() {
-			db.mergingChannel <- 1
-		}()
+// submit hands a write to the writer goroutine and waits for its result.
+func (db *Datastore) submit(query putQuery) error {
+	if db.readOnly {
+		return ErrReadOnly
 	}
 
-	e := pe.entry
+	atomic.AddInt64(&db.putQueue, 1)
+	defer atomic.AddInt64(&db.putQueue, -1)
 
-	n, err := db.out.Write(e.Encode())
+	query.callback = make(chan error)
+	db.putChannel <- query
+
+	return <-query.callback
+}
+
+// versions returns the version of the latest record of a key and the version
+// the key reads at, which is zero once it is deleted or expired. Keys without
+// records are at the floor, as merge may have dropped their records.
+func (db *Datastore) versions(key string) (latest, live uint64, err error) {
+	v := db.pin(false)
+	defer v.release()
+
+	e, err := v.lookup(key)
+	if errors.Is(err, ErrNotFound) {
+		return atomic.LoadUint64(&db.floor), 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	if _, err = e.live(time.Now()); err != nil {
+		return e.version, 0, nil
+	}
+
+	return e.version, e.version, nil
+}
+
+// put appends a group of queued writes to the active segment and, when
+// every write has to be durable, commits all of them with a single fsync.
+func (db *Datastore) put(batch []putQuery) error {
+	var (
+		results = make([]error, len(batch))
+		err     error
+	)
+
+	for i, pe := range batch {
+		var size int64
+
+		if pe.expected != nil {
+			if results[i] = db.check(pe.entries[0].key, *pe.expected); results[i] != nil {
+				continue
+			}
+		}
+
+		if pe.delta != nil {
+			if results[i] = db.increment(pe.entries[0], *pe.delta); results[i] != nil {
+				continue
+			}
+		}
+
+		if pe.replicated {
+			size, results[i] = db.applyReplicated(pe)
+		} else {
+			size, results[i] = db.append(pe.entries)
+		}
+
+		if results[i] != nil {
+			continue
+		}
+
+		if size >= db.currentBlockSize {
+			if _, err = db.addSegment(); err != nil {
+				// The writes left were never appended.
+				for j := i + 1; j < len(batch); j++ {
+					results[j] = err
+				}
+
+				break
+			}
+		}
+	}
+
+	if mode, _ := db.SyncMode(); mode == SyncAlways {
+		if syncErr := db.sync(); syncErr != nil {
+			for i := range results {
+				if results[i] == nil {
+					results[i] = syncErr
+				}
+			}
+		}
+	}
+
+	for i, pe := range batch {
+		pe.callback <- results[i]
+	}
+
+	db.mutex.RLock()
+	compaction := db.compaction
+	db.mutex.RUnlock()
+
+	if compaction != nil {
+		select {
+		case db.mergingChannel <- 1:
+		default:
+		}
+	}
+
+	return err
+}
+
+// check fails a conditional write of a key that is not at the expected
+// version. It runs on the writer goroutine, so the version cannot change
+// before the write is appended.
+func (db *Datastore) check(key string, expected uint64) error {
+	_, live, err := db.versions(key)
 	if err != nil {
-		pe.callback <- err
+		return err
+	}
+
+	if live != expected {
+		return fmt.Errorf("%w: %s is at version %d, not %d", ErrVersionConflict, key, live, expected)
+	}
 
+	return nil
+}
+
+// increment sets the value of an entry to the current value of its key plus
+// delta. Like check it relies on running on the writer goroutine.
+func (db *Datastore) increment(e *entry, delta int64) error {
+	v := db.pin(false)
+	defer v.release()
+
+	var n int64
+
+	value, err := v.get(e.key)
+	if err == nil {
+		if n, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+			return fmt.Errorf("%w: %s holds %q", ErrNotInteger, e.key, value)
+		}
+	} else if !errors.Is(err, ErrNotFound) {
 		return err
 	}
 
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return fmt.Errorf("%w: %d%+d", ErrOverflow, n, delta)
+	}
+
+	e.value = []byte(strconv.FormatInt(n+delta, 10))
+
+	return nil
+}
+
+// append numbers entries and writes them to the active segment, returning the
+// new segment size.
+func (db *Datastore) append(entries []*entry) (int64, error) {
+	versions := make(map[string]uint64, len(entries))
+
+	for _, e := range entries {
+		version, ok := versions[e.key]
+		if !ok {
+			var err error
+
+			if version, _, err = db.versions(e.key); err != nil {
+				return 0, err
+			}
+		}
+
+		e.version = version + 1
+		versions[e.key] = e.version
+	}
+
+	seq := db.seq
+
+	for _, e := range entries {
+		seq++
+		e.seq = seq
+	}
+
+	return db.commit(entries, seq)
+}
+
+// applyReplicated appends the entries of a replicated write the datastore
+// does not have yet.
+func (db *Datastore) applyReplicated(pe putQuery) (int64, error) {
+	if pe.reset {
+		if err := db.reset(pe.seq); err != nil {
+			return 0, err
+		}
+	}
+
+	entries := make([]*entry, 0, len(pe.entries))
+	seq := db.seq
+
+	for _, e := range pe.entries {
+		if e.seq > db.seq {
+			entries = append(entries, e)
+		}
+
+		if e.seq > seq {
+			seq = e.seq
+		}
+	}
+
+	if pe.seq > seq {
+		seq = pe.seq
+	}
+
+	return db.commit(entries, seq)
+}
+
+// commit writes entries that have their sequence numbers and versions set to
+// the active segment with a single call, bringing the sequence number up to
+// seq. Several entries are framed by a batch header so that restore applies
+// them together.
+func (db *Datastore) commit(entries []*entry, seq uint64) (int64, error) {
+	var (
+		data      []byte
+		positions = make([]position, len(entries))
+		keyring   *Keyring
+		f         format
+	)
+
+	if len(entries) > 0 {
+		var err error
+
+		if keyring, f, err = db.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(entries) > 1 {
+		data = batchHeader(len(entries)).Encode()
+	}
+
+	for i, e := range entries {
+		record, err := f.encode(keyring, e)
+		if err != nil {
+			return 0, err
+		}
+
+		positions[i] = position{offset: int64(len(data)), size: int64(len(record))}
+		data = append(data, record...)
+	}
+
+	var (
+		n   int
+		err error
+	)
+
+	if len(data) > 0 {
+		if n, err = db.out.Write(data); err != nil {
+			return 0, err
+		}
+	}
+
 	db.mutex.Lock()
+	defer db.mutex.Unlock()
 
 	activeSegment := db.segments[0]
-	activeSegment.index[e.key] = activeSegment.offset
+	if len(entries) > 0 {
+		activeSegment.marks = append(activeSegment.marks, mark{seq: entries[0].seq, offset: activeSegment.offset})
+	}
+
+	for i, e := range entries {
+		db.shadow(e.key)
+		activeSegment.index[e.key] = position{offset: activeSegment.offset + positions[i].offset, size: positions[i].size}
+		activeSegment.live += positions[i].size
+		activeSegment.seen(e)
+	}
 	activeSegment.offset += int64(n)
+	db.seq = seq
 
-	db.mutex.Unlock()
+	close(db.changed)
+	db.changed = make(chan struct{})
 
-	fi, err := os.Stat(activeSegment.path)
-	if err != nil {
-		pe.callback <- nil
+	return activeSegment.offset, nil
+}
 
-		return fmt.Errorf("can not read active file stat: %v", err)
+// reset seals the active segment and drops every segment, the records they
+// held up to horizon can no longer be replayed. It runs on the writer
+// goroutine.
+func (db *Datastore) reset(horizon uint64) error {
+	active, err := db.addSegment()
+	if err != nil {
+		return err
 	}
 
-	if fi.Size() >= db.currentBlockSize {
-		_, err = db.addSegment()
-		if err != nil {
-			pe.callback <- nil
+	// The header of the new active segment keeps the horizon over restarts.
+	header := segmentHeader(format{})
+	header.seq = horizon
 
-			return err
-		}
+	n, err := db.out.Write(header.Encode())
+	if err != nil {
+		return err
 	}
 
-	pe.callback <- nil
+	db.mutex.Lock()
+	dropped := db.segments[1:]
+	db.segments = db.segments[:1]
+	db.seq = 0
+	active.horizon = horizon
+	active.offset += int64(n)
+	active.live += int64(n)
+	db.mutex.Unlock()
+
+	atomic.StoreUint64(&db.horizon, horizon)
+
+	for _, s := range dropped {
+		s.retire()
+		db.files.evict(s)
+	}
 
 	return nil
 }
 
 func (db *Datastore) addSegment() (*segment, error) {
+	mode, _ := db.SyncMode()
+
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
-	if err := db.out.Close(); err != nil {
-		return nil, err
+	if mode != SyncNever {
+		if err := db.out.Sync(); err != nil {
+			return nil, err
+		}
 	}
 
-	segmentSuffix := 0
-
-	if len(db.segments) > 1 {
-		var (
-			lastSavedSegmentSuffix = db.segments[1].path[len(db.dir+segmentPrefix)+1:]
-		)
-
-		if prevSegmentSuffix, err := strconv.Atoi(lastSavedSegmentSuffix); err == nil {
-			segmentSuffix = prevSegmentSuffix + 1
-		}
+	if err := db.out.Close(); err != nil {
+		return nil, err
 	}
 
-	segmentPath := filepath.Join(db.dir, fmt.Sprintf("%v%v", segmentPrefix, segmentSuffix))
+	segmentPath := db.segmentPath()
 	outputPath := filepath.Join(db.dir, segmentPrefix+currentSegmentSuffix)
 
 	if err := os.Rename(outputPath, segmentPath); err != nil {
 		return nil, err
 	}
 
-	db.segments[0].path = segmentPath
+	sealed := db.segments[0]
+	sealed.path = segmentPath
+
+	if err := sealed.writeHint(); err != nil {
+		db.logger.Printf("can't write hint file of %s: %v", sealed.path, err)
+	}
+
+	sealed.buildFilter()
 
 	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
 	if err != nil {
@@ -269,24 +839,66 @@ func (db *Datastore) addSegment() (*segment, error) {
 	db.out = f
 
 	s := &segment{
-		path:  outputPath,
-		index: make(hashIndex),
+		path:   outputPath,
+		index:  make(hashIndex),
+		logger: db.logger,
 	}
 	db.segments = append([]*segment{s}, db.segments...)
 
 	return s, nil
 }
 
+// segmentPath allocates a file name for a new sealed segment, it has to be
+// called with the mutex held.
+func (db *Datastore) segmentPath() string {
+	path := filepath.Join(db.dir, fmt.Sprintf("%v%v", segmentPrefix, db.nextID))
+	db.nextID++
+
+	return path
+}
+
+// merge merges every sealed segment into one.
 func (db *Datastore) merge() error {
+	db.mutex.RLock()
 	toMerge := db.segments[1:]
 	segments := make([]*segment, len(toMerge))
 
 	copy(segments, toMerge)
+	db.mutex.RUnlock()
 
 	if len(segments) < 2 {
 		return fmt.Errorf("not enough segments to merge")
 	}
 
+	return db.mergeSegments(segments)
+}
+
+// mergeSegments replaces a run of adjacent sealed segments with a single one
+// holding the latest record of each of their keys.
+func (db *Datastore) mergeSegments(segments []*segment) error {
+	db.mergeMutex.Lock()
+	defer db.mergeMutex.Unlock()
+
+	start := time.Now()
+
+	db.mutex.RLock()
+
+	first := db.find(segments)
+	if first < 0 {
+		db.mutex.RUnlock()
+
+		return fmt.Errorf("segments to merge are gone")
+	}
+
+	// Indexes of sealed segments do not change, so they are safe to read
+	// without the mutex.
+	newer := db.segments[1:first]
+	older := db.segments[first+len(segments):]
+	// Merged segments are written in the configured format, which is how
+	// values get recompressed or encrypted with a rotated key.
+	keyring, target := db.keyring, db.format()
+	db.mutex.RUnlock()
+
 	keysSegments := make(map[string]*segment)
 
 	for i := len(segments) - 1; i >= 0; i-- {
@@ -296,68 +908,251 @@ func (db *Datastore) merge() error {
 		}
 	}
 
+	inputs := make(map[*segment]*os.File, len(segments))
+
+	defer func() {
+		for _, input := range inputs {
+			_ = input.Close()
+		}
+	}()
+
+	for _, s := range segments {
+		input, err := os.Open(s.path)
+		if err != nil {
+			return fmt.Errorf("error occured during merging: %v", err)
+		}
+
+		inputs[s] = input
+	}
+
 	segmentPath := filepath.Join(db.dir, segmentPrefix)
 
-	f, err := os.OpenFile(segmentPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	f, err := os.OpenFile(segmentPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0o600)
 	if err != nil {
 		return fmt.Errorf("error occured during merging: %v", err)
 	}
 
 	defer func(f *os.File) {
-		err = f.Close()
-		if err != nil {
+		if err := f.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
 			log.Panic(err)
 		}
 	}(f)
 
 	seg := &segment{
-		path:  segmentPath,
-		index: make(hashIndex),
+		path:   segmentPath,
+		index:  make(hashIndex),
+		logger: db.logger,
+		format: target,
+	}
+
+	// The header is rewritten once the records dropped are known.
+	n, err := f.Write(segmentHeader(target).Encode())
+	if err != nil {
+		return fmt.Errorf("error occured during merging: %v", err)
+	}
+
+	seg.offset += int64(n)
+	seg.live += int64(n)
+
+	now := time.Now()
+
+	for _, s := range segments {
+		if s.horizon > seg.horizon {
+			seg.horizon = s.horizon
+		}
+
+		if s.floor > seg.floor {
+			seg.floor = s.floor
+		}
 	}
 
 	for k, s := range keysSegments {
-		var value []byte
+		if contains(newer, k) {
+			continue
+		}
 
-		if value, err = s.get(k); value != nil && err == nil {
-			e := (&entry{
-				key:   k,
-				value: value,
-			}).Encode()
+		db.compactionLimiter.wait(s.index[k].size)
 
-			n, err := f.Write(e)
-			if err != nil {
-				return fmt.Errorf("error occured during merging: %v", err)
+		e, err := entryAt(inputs[s], s.index[k].offset)
+		if err == nil {
+			err = s.format.decode(keyring, e)
+		}
+
+		if err != nil {
+			return fmt.Errorf("error occured during merging: %w", err)
+		}
+
+		// Deleted and expired keys are left out unless an older segment still
+		// holds a value for them to hide.
+		if (e.kind == entryDelete || e.expired(now)) && !contains(older, k) {
+			if e.seq > seg.horizon {
+				seg.horizon = e.seq
 			}
 
-			seg.index[k] = seg.offset
-			seg.offset += int64(n)
+			if e.version > seg.floor {
+				seg.floor = e.version
+			}
+
+			continue
 		}
+
+		record, err := target.encode(keyring, e)
+		if err != nil {
+			return fmt.Errorf("error occured during merging: %w", err)
+		}
+
+		db.compactionLimiter.wait(int64(len(record)))
+
+		n, err := f.Write(record)
+		if err != nil {
+			return fmt.Errorf("error occured during merging: %v", err)
+		}
+
+		seg.index[k] = position{offset: seg.offset, size: int64(n)}
+		seg.offset += int64(n)
+		seg.seen(e)
 	}
 
-	db.mutex.Lock()
+	header := segmentHeader(target)
+	header.seq, header.version = seg.horizon, seg.floor
+
+	if _, err = f.WriteAt(header.Encode(), 0); err != nil {
+		return fmt.Errorf("error occured during merging: %v", err)
+	}
 
-	newPath := segmentPath + mergedSegmentSuffix
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("error occured during merging: %v", err)
+	}
+
+	for floor := atomic.LoadUint64(&db.floor); seg.floor > floor; floor = atomic.LoadUint64(&db.floor) {
+		if atomic.CompareAndSwapUint64(&db.floor, floor, seg.floor) {
+			break
+		}
+	}
 
-	if err = os.Rename(segmentPath, newPath); err != nil {
+	for horizon := atomic.LoadUint64(&db.horizon); seg.horizon > horizon; horizon = atomic.LoadUint64(&db.horizon) {
+		if atomic.CompareAndSwapUint64(&db.horizon, horizon, seg.horizon) {
+			break
+		}
+	}
+
+	db.mutex.Lock()
+
+	if first = db.find(segments); first < 0 {
 		db.mutex.Unlock()
 
-		return fmt.Errorf("can't merge: %v", err)
+		_ = os.Remove(segmentPath)
+
+		return fmt.Errorf("segments to merge are gone")
 	}
 
-	seg.path = newPath
-	to := len(db.segments) - len(segments)
-	db.segments = append(db.segments[:to], seg)
+	merged := make([]*segment, 0, len(db.segments)-len(segments)+1)
+	merged = append(merged, db.segments[:first]...)
 
+	// A segment left without records still keeps the horizon and the floor.
+	if len(seg.index) > 0 || seg.horizon > 0 || seg.floor > 0 {
+		newPath := db.segmentPath()
+
+		if err = os.Rename(segmentPath, newPath); err != nil {
+			db.mutex.Unlock()
+
+			return fmt.Errorf("can't merge: %v", err)
+		}
+
+		seg.path = newPath
+
+		for k, pos := range seg.index {
+			if !contains(db.segments[:first], k) {
+				seg.live += pos.size
+			}
+		}
+
+		merged = append(merged, seg)
+
+		if err = seg.writeHint(); err != nil {
+			db.logger.Printf("can't write hint file of %s: %v", seg.path, err)
+		}
+
+		seg.buildFilter()
+	} else if err = os.Remove(segmentPath); err != nil {
+		db.logger.Printf("can't remove empty merged segment: %v", err)
+	}
+
+	db.segments = append(merged, db.segments[first+len(segments):]...)
 	db.mutex.Unlock()
 
 	for _, s := range segments {
-		if newPath != s.path {
-			err = os.Remove(s.path)
-			if err != nil {
-				log.Panic(err)
+		s.retire()
+		db.files.evict(s)
+	}
+
+	took := int64(time.Since(start))
+
+	atomic.AddInt64(&db.merges, 1)
+	atomic.AddInt64(&db.mergeTime, took)
+	atomic.StoreInt64(&db.lastMergeTime, took)
+
+	return nil
+}
+
+// find returns the position of a run of segments in the segment list or -1
+// if it is not there, it has to be called with the mutex held.
+func (db *Datastore) find(run []*segment) int {
+	for i, s := range db.segments {
+		if s != run[0] {
+			continue
+		}
+
+		if i+len(run) > len(db.segments) {
+			return -1
+		}
+
+		for j := range run {
+			if db.segments[i+j] != run[j] {
+				return -1
 			}
 		}
+
+		return i
 	}
 
-	return nil
+	return -1
+}
+
+// contains reports whether any of the segments has a record of the key.
+func contains(segments []*segment, key string) bool {
+	for _, s := range segments {
+		if _, ok := s.index[key]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// shadow accounts for a new record of the key, making the previous one dead.
+// It has to be called with the mutex held, before the key is indexed.
+func (db *Datastore) shadow(key string) {
+	for _, s := range db.segments {
+		if pos, ok := s.index[key]; ok {
+			s.live -= pos.size
+
+			return
+		}
+	}
+}
+
+// countLive sums up the records of segments ordered from the newest that
+// are not overwritten by a newer one.
+func countLive(segments []*segment) {
+	seen := make(map[string]struct{})
+
+	for _, s := range segments {
+		for k, pos := range s.index {
+			if _, ok := seen[k]; !ok {
+				s.live += pos.size
+				seen[k] = struct{}{}
+			}
+		}
+	}
 }
@@ -2,9 +2,15 @@ package datastore
 
 import (
 	"bytes"
+	"errors"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -37,6 +43,37 @@ var (
 	}
 )
 
+func sortedKeys(data map[string][]byte) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// segmentFiles lists the segment files in dir, leaving out the hint and
+// bloom filter files kept next to them.
+func segmentFiles(dir string) ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []os.FileInfo
+
+	for _, fileInfo := range files {
+		s := &segment{path: fileInfo.Name()}
+		if s.suffix() == currentSegmentSuffix || s.id() >= 0 {
+			segments = append(segments, fileInfo)
+		}
+	}
+
+	return segments, nil
+}
+
 func TestDatastore_Put(t *testing.T) {
 	dir, err := ioutil.TempDir("", "test-db")
 	if err != nil {
@@ -147,7 +184,15 @@ func TestDatastore_Segmentation(t *testing.T) {
 		}
 	}
 
-	files, err := ioutil.ReadDir(dir)
+	// Segments are merged in the background.
+	var files []os.FileInfo
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if files, err = segmentFiles(dir); err != nil || len(files) == 2 {
+			break
+		}
+	}
+
 	if err != nil {
 		t.Error(err)
 	}
@@ -174,24 +219,25 @@ func TestDatastore_Merge(t *testing.T) {
 		}
 	}(dir)
 
-	db, err := NewDatastoreMergeToSize(dir, 44, false)
+	db, err := NewDatastoreMergeToSize(dir, 52, false)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	for key, val := range dataset {
-		if err = db.Put(key, val); err != nil {
+	// The expected merged segment depends on the order keys are written in.
+	for _, key := range sortedKeys(dataset) {
+		if err = db.Put(key, dataset[key]); err != nil {
 			t.Fatal(err)
 		}
 	}
 
-	for key, val := range anotherDataset {
-		if err = db.Put(key, val); err != nil {
+	for _, key := range sortedKeys(anotherDataset) {
+		if err = db.Put(key, anotherDataset[key]); err != nil {
 			t.Fatal(err)
 		}
 	}
 
-	files, err := ioutil.ReadDir(dir)
+	files, err := segmentFiles(dir)
 	if err != nil {
 		t.Error(err)
 	}
@@ -202,7 +248,7 @@ func TestDatastore_Merge(t *testing.T) {
 
 	_ = db.merge()
 
-	files, err = ioutil.ReadDir(dir)
+	files, err = segmentFiles(dir)
 	if err != nil {
 		t.Error(err)
 	}
@@ -219,7 +265,20 @@ func TestDatastore_Merge(t *testing.T) {
 	}
 
 	for key, val := range expectedMergedSegment {
-		value, err := mergedSegment.get(key)
+		pos, ok := mergedSegment.index[key]
+		if !ok {
+			t.Errorf("%s is not in the merged segment", key)
+
+			continue
+		}
+
+		var value []byte
+
+		e, err := db.read(mergedSegment, pos.offset)
+		if err == nil {
+			value, err = e.live(time.Now())
+		}
+
 		if err != nil {
 			t.Errorf("can't get %s: %s", key, err)
 		}
@@ -297,3 +356,788 @@ func TestDatastore_Concurrency(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDatastore_Delete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 44, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, val := range dataset {
+		if err = db.Put(key, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("delete hides older segments", func(t *testing.T) {
+		if err = db.Delete("key1"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = db.Get("key1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected %s, got %v", ErrNotFound, err)
+		}
+
+		if _, err = db.Get("key2"); err != nil {
+			t.Errorf("can't get key2: %s", err)
+		}
+	})
+
+	t.Run("new db process", func(t *testing.T) {
+		if err = db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if db, err = NewDatastoreMergeToSize(dir, 44, false); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = db.Get("key1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected %s, got %v", ErrNotFound, err)
+		}
+	})
+
+	t.Run("merge drops tombstones", func(t *testing.T) {
+		if _, err = db.addSegment(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = db.merge(); err != nil {
+			t.Fatal(err)
+		}
+
+		merged := db.segments[len(db.segments)-1]
+		if _, ok := merged.index["key1"]; ok {
+			t.Error("deleted key is still present in the merged segment")
+		}
+
+		if _, err = db.Get("key1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected %s, got %v", ErrNotFound, err)
+		}
+
+		for _, key := range []string{"key2", "key3"} {
+			value, err := db.Get(key)
+			if err != nil {
+				t.Errorf("can't get %s: %s", key, err)
+			}
+
+			if !bytes.Equal(value, dataset[key]) {
+				t.Errorf("wrong value returned expected %s, got %s", dataset[key], value)
+			}
+		}
+	})
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDatastore_Corruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 44, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Put("key1", []byte("purple")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Put("key2", []byte("orange")); err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := db.segments[1]
+	offset := sealed.index["key2"].offset
+
+	data, err := ioutil.ReadFile(sealed.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[len(data)-1] ^= 0xff
+
+	if err = ioutil.WriteFile(sealed.path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("get", func(t *testing.T) {
+		if _, err = db.Get("key1"); err != nil {
+			t.Errorf("can't get key1: %s", err)
+		}
+
+		_, err = db.Get("key2")
+		if !errors.Is(err, ErrCorruptedFile) {
+			t.Fatalf("expected %s, got %v", ErrCorruptedFile, err)
+		}
+
+		if !strings.Contains(err.Error(), sealed.path) || !strings.Contains(err.Error(), strconv.FormatInt(offset, 10)) {
+			t.Errorf("error does not point at the damaged record: %s", err)
+		}
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		if err = db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// A valid hint file spares reading the segment on open.
+		if err = os.Remove(sealed.path + hintSuffix); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = NewDatastore(dir); !errors.Is(err, ErrCorruptedFile) {
+			t.Errorf("expected %s, got %v", ErrCorruptedFile, err)
+		}
+	})
+}
+
+func TestDatastore_Recovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"key1", "key2"} {
+		if err = db.Put(key, dataset[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lastOffset := db.segments[0].offset
+
+	if err = db.Put("key3", dataset["key3"]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	currentPath := filepath.Join(dir, segmentPrefix+currentSegmentSuffix)
+
+	data, err := ioutil.ReadFile(currentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for size := lastOffset + 1; size < int64(len(data)); size++ {
+		if err = ioutil.WriteFile(currentPath, data[:size], 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if db, err = NewDatastore(dir); err != nil {
+			t.Fatalf("torn at %d: can't open: %s", size, err)
+		}
+
+		fi, err := os.Stat(currentPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.Size() != lastOffset {
+			t.Errorf("torn at %d: expected truncation to %d, got %d", size, lastOffset, fi.Size())
+		}
+
+		for _, key := range []string{"key1", "key2"} {
+			value, err := db.Get(key)
+			if err != nil {
+				t.Errorf("torn at %d: can't get %s: %s", size, key, err)
+			}
+
+			if !bytes.Equal(value, dataset[key]) {
+				t.Errorf("torn at %d: wrong value returned expected %s, got %s", size, dataset[key], value)
+			}
+		}
+
+		if _, err = db.Get("key3"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("torn at %d: expected %s, got %v", size, ErrNotFound, err)
+		}
+
+		if err = db.Put("key3", dataset["key3"]); err != nil {
+			t.Fatalf("torn at %d: can't put after recovery: %s", size, err)
+		}
+
+		if value, err := db.Get("key3"); err != nil || !bytes.Equal(value, dataset["key3"]) {
+			t.Errorf("torn at %d: can't get key3 after recovery: %v", size, err)
+		}
+
+		if err = db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDatastore_RecoveryDamaged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"key1", "key2", "key3", "key4"} {
+		if err = db.Put(key, dataset[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	currentPath := filepath.Join(dir, segmentPrefix+currentSegmentSuffix)
+
+	data, err := ioutil.ReadFile(currentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[entryHeaderSize] ^= 0x10
+
+	if err = ioutil.WriteFile(currentPath, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewDatastore(dir); !errors.Is(err, ErrCorruptedFile) {
+		t.Errorf("expected %s, got %v", ErrCorruptedFile, err)
+	}
+
+	if _, err = Open(dir, ReadOnly()); !errors.Is(err, ErrCorruptedFile) {
+		t.Errorf("expected %s in read-only mode, got %v", ErrCorruptedFile, err)
+	}
+
+	fi, err := os.Stat(currentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() != int64(len(data)) {
+		t.Errorf("expected the segment to be kept at %d bytes, got %d", len(data), fi.Size())
+	}
+}
+
+func TestDatastore_Expiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 44, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	past := time.Now().Add(-time.Second)
+	future := time.Now().Add(time.Hour)
+
+	if err = db.Put("key2", dataset["key2"]); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expiresAt := range map[string]time.Time{
+		"key1": past,
+		"key2": past,
+		"key3": future,
+	} {
+		if err = db.PutWithExpiry(key, dataset[key], expiresAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(t *testing.T) {
+		for _, key := range []string{"key1", "key2"} {
+			if _, err := db.Get(key); !errors.Is(err, ErrNotFound) {
+				t.Errorf("expected %s for %s, got %v", ErrNotFound, key, err)
+			}
+		}
+
+		if value, err := db.Get("key3"); err != nil || !bytes.Equal(value, dataset["key3"]) {
+			t.Errorf("can't get key3: %s, %v", value, err)
+		}
+	}
+
+	t.Run("get", check)
+
+	t.Run("merge drops expired entries", func(t *testing.T) {
+		if _, err = db.addSegment(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = db.merge(); err != nil {
+			t.Fatal(err)
+		}
+
+		merged := db.segments[len(db.segments)-1]
+		for _, key := range []string{"key1", "key2"} {
+			if _, ok := merged.index[key]; ok {
+				t.Errorf("expired %s is still present in the merged segment", key)
+			}
+		}
+
+		check(t)
+	})
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDatastore_CompareAndSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version := func(t *testing.T, key string) uint64 {
+		_, v, err := db.GetWithVersion(key)
+		if err != nil {
+			t.Fatalf("can't get %s: %v", key, err)
+		}
+
+		return v
+	}
+
+	t.Run("put if absent", func(t *testing.T) {
+		if err = db.PutIfAbsent("key1", []byte("purple")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = db.PutIfAbsent("key1", []byte("orange")); !errors.Is(err, ErrVersionConflict) {
+			t.Errorf("expected %s, got %v", ErrVersionConflict, err)
+		}
+
+		if v := version(t, "key1"); v != 1 {
+			t.Errorf("got version %d, want 1", v)
+		}
+	})
+
+	t.Run("swap", func(t *testing.T) {
+		if err = db.CompareAndSwap("key1", 1, []byte("silver")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = db.CompareAndSwap("key1", 1, []byte("father")); !errors.Is(err, ErrVersionConflict) {
+			t.Errorf("expected %s, got %v", ErrVersionConflict, err)
+		}
+
+		value, v, err := db.GetWithVersion("key1")
+		if err != nil || string(value) != "silver" || v != 2 {
+			t.Errorf("got %s at version %d, %v", value, v, err)
+		}
+	})
+
+	t.Run("deleted", func(t *testing.T) {
+		if err = db.Delete("key1"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = db.CompareAndSwap("key1", 2, []byte("mother")); !errors.Is(err, ErrVersionConflict) {
+			t.Errorf("expected %s, got %v", ErrVersionConflict, err)
+		}
+
+		// Versions keep growing after a delete, so stale ones never match.
+		if err = db.PutIfAbsent("key1", []byte("mother")); err != nil {
+			t.Fatal(err)
+		}
+
+		if v := version(t, "key1"); v != 4 {
+			t.Errorf("got version %d, want 4", v)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		const workers, increments = 4, 25
+
+		if err = db.Put("counter", []byte{0}); err != nil {
+			t.Fatal(err)
+		}
+
+		errs := make(chan error, workers)
+
+		for i := 0; i < workers; i++ {
+			go func() {
+				for n := 0; n < increments; {
+					value, v, err := db.GetWithVersion("counter")
+					if err != nil {
+						errs <- err
+
+						return
+					}
+
+					err = db.CompareAndSwap("counter", v, []byte{value[0] + 1})
+					if errors.Is(err, ErrVersionConflict) {
+						continue
+					} else if err != nil {
+						errs <- err
+
+						return
+					}
+
+					n++
+				}
+
+				errs <- nil
+			}()
+		}
+
+		for i := 0; i < workers; i++ {
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		value, v, err := db.GetWithVersion("counter")
+		if err != nil || value[0] != workers*increments || v != workers*increments+1 {
+			t.Errorf("got %d at version %d, %v", value, v, err)
+		}
+	})
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("restore", func(t *testing.T) {
+		if db, err = NewDatastoreMergeToSize(dir, 100, false); err != nil {
+			t.Fatal(err)
+		}
+
+		defer func(db *Datastore) {
+			_ = db.Close()
+		}(db)
+
+		if v := version(t, "key1"); v != 4 {
+			t.Errorf("got version %d, want 4", v)
+		}
+
+		if err = db.merge(); err != nil {
+			t.Fatal(err)
+		}
+
+		if v := version(t, "counter"); v != 101 {
+			t.Errorf("got version %d after merge, want 101", v)
+		}
+	})
+}
+
+func TestDatastore_VersionsAfterMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range []string{"purple", "silver"} {
+		if err = db.Put("key1", []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.addSegment(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tombstone is dropped along with every other record of the key.
+	if err = db.merge(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = NewDatastoreMergeToSize(dir, 100, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.PutIfAbsent("key1", []byte("mother")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.CompareAndSwap("key1", 1, []byte("father")); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("expected %s for a version of the dropped key, got %v", ErrVersionConflict, err)
+	}
+
+	if _, v, err := db.GetWithVersion("key1"); err != nil || v != 4 {
+		t.Errorf("got version %d, want 4, %v", v, err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDatastore_SeqAfterMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopen := func(t *testing.T) {
+		if err = db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if db, err = NewDatastoreMergeToSize(dir, 100, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, key := range []string{"key1", "key2"} {
+		if err = db.Put(key, dataset[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = db.addSegment(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("sealed", func(t *testing.T) {
+		reopen(t)
+
+		// Nothing was merged, so the whole history is still there.
+		if _, err = db.Changes(0, ioutil.Discard); err != nil {
+			t.Errorf("can't read changes after reopening: %v", err)
+		}
+	})
+
+	t.Run("merged", func(t *testing.T) {
+		if err = db.Delete("key2"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = db.addSegment(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The delete, the latest write, is dropped along with key2.
+		if err = db.merge(); err != nil {
+			t.Fatal(err)
+		}
+
+		reopen(t)
+
+		if seq := db.Seq(); seq != 3 {
+			t.Errorf("got sequence number %d after reopening, want 3", seq)
+		}
+
+		if _, err = db.Changes(1, ioutil.Discard); !errors.Is(err, ErrHistoryTruncated) {
+			t.Errorf("expected %s behind the dropped delete, got %v", ErrHistoryTruncated, err)
+		}
+
+		if _, err = db.Changes(3, ioutil.Discard); err != nil {
+			t.Errorf("can't read changes from the latest write: %v", err)
+		}
+	})
+
+	t.Run("ahead", func(t *testing.T) {
+		if _, err = db.Changes(4, ioutil.Discard); !errors.Is(err, ErrHistoryTruncated) {
+			t.Errorf("expected %s ahead of the datastore, got %v", ErrHistoryTruncated, err)
+		}
+	})
+
+	t.Run("loaded", func(t *testing.T) {
+		var buf bytes.Buffer
+
+		if _, err = db.Dump(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = db.Load(buf.Bytes(), 10); err != nil {
+			t.Fatal(err)
+		}
+
+		reopen(t)
+
+		if seq := db.Seq(); seq != 10 {
+			t.Errorf("got sequence number %d after reopening, want 10", seq)
+		}
+
+		if _, err = db.Changes(5, ioutil.Discard); !errors.Is(err, ErrHistoryTruncated) {
+			t.Errorf("expected %s behind the load, got %v", ErrHistoryTruncated, err)
+		}
+
+		if value, err := db.Get("key1"); err != nil || !bytes.Equal(value, dataset["key1"]) {
+			t.Errorf("can't get key1 after the load: %s, %v", value, err)
+		}
+	})
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDatastore_Increment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(db *Datastore) {
+		_ = db.Close()
+	}(db)
+
+	t.Run("missing", func(t *testing.T) {
+		if n, err := db.Increment("counter", 5); err != nil || n != 5 {
+			t.Errorf("got %d, %v", n, err)
+		}
+
+		if n, err := db.Increment("counter", -7); err != nil || n != -2 {
+			t.Errorf("got %d, %v", n, err)
+		}
+
+		if value, err := db.Get("counter"); err != nil || string(value) != "-2" {
+			t.Errorf("got %s, %v", value, err)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		const workers, increments = 8, 50
+
+		var wg sync.WaitGroup
+
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for n := 0; n < increments; n++ {
+					if _, err := db.Increment("hits", 1); err != nil {
+						t.Error(err)
+
+						return
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		if value, err := db.Get("hits"); err != nil || string(value) != strconv.Itoa(workers*increments) {
+			t.Errorf("got %s, %v", value, err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		if err = db.Put("name", []byte("purple")); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = db.Increment("name", 1); !errors.Is(err, ErrNotInteger) {
+			t.Errorf("expected %s, got %v", ErrNotInteger, err)
+		}
+
+		if err = db.Put("max", []byte(strconv.FormatInt(math.MaxInt64, 10))); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = db.Increment("max", 1); !errors.Is(err, ErrOverflow) {
+			t.Errorf("expected %s, got %v", ErrOverflow, err)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package datastore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// ErrUnknownKey is returned when reading a segment encrypted with a key that
+// is not in the keyring.
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// Keyring holds the keys segments are encrypted with. New segments use the
+// active key, the others are kept to read segments written before a
+// rotation until merge rewrites them.
+type Keyring struct {
+	keys   map[string]cipher.AEAD
+	active string
+}
+
+// ParseKeyring reads keys given one per line or separated by commas as
+// <id>:<hex encoded AES key>. The last key is the active one.
+func ParseKeyring(text string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+
+	for _, line := range strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid key %q, want <id>:<hex key>", line)
+		}
+
+		if len(parts[0]) > 255 {
+			return nil, fmt.Errorf("key id %q is too long", parts[0])
+		}
+
+		secret, err := hex.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", parts[0], err)
+		}
+
+		block, err := aes.NewCipher(secret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", parts[0], err)
+		}
+
+		if k.keys[parts[0]], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+
+		k.active = parts[0]
+	}
+
+	if len(k.keys) == 0 {
+		return nil, errors.New("no encryption keys")
+	}
+
+	return k, nil
+}
+
+// LoadKeyring reads a key file in the ParseKeyring format.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseKeyring(string(data))
+}
+
+// encrypt seals the value of a record with the key, the record key is
+// authenticated along with it.
+func (k *Keyring) encrypt(id, key string, value []byte) ([]byte, error) {
+	if k == nil {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, value, []byte(key)), nil
+}
+
+func (k *Keyring) decrypt(id, key string, value []byte) ([]byte, error) {
+	if k == nil {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+
+	if len(value) < aead.NonceSize() {
+		return nil, ErrCorruptedFile
+	}
+
+	nonce, sealed := value[:aead.NonceSize()], value[aead.NonceSize():]
+
+	plain, err := aead.Open(nil, nonce, sealed, []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("%w: can't decrypt value of %s", ErrCorruptedFile, key)
+	}
+
+	return plain, nil
+}
+
+// SetKeyring turns encryption of new segments on, or off with nil. The
+// active segment is sealed with the next write if it was started with
+// another key, older segments keep theirs until they are merged.
+func (db *Datastore) SetKeyring(k *Keyring) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.keyring = k
+}
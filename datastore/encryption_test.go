@@ -0,0 +1,208 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testKey1 = "k1:000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testKey2 = "k2:1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+func TestParseKeyring(t *testing.T) {
+	k, err := ParseKeyring(testKey1 + "\n" + testKey2 + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if k.active != "k2" || len(k.keys) != 2 {
+		t.Errorf("unexpected keyring: %d keys, %s active", len(k.keys), k.active)
+	}
+
+	for _, text := range []string{"", "k1", ":00", "k1:zz", "k1:0001"} {
+		if _, err = ParseKeyring(text); err == nil {
+			t.Errorf("expected an error for %q", text)
+		}
+	}
+}
+
+func TestDatastore_Encryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	keyring := func(t *testing.T, text string) *Keyring {
+		t.Helper()
+
+		k, err := ParseKeyring(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return k
+	}
+
+	open := func(t *testing.T, k *Keyring) *Datastore {
+		t.Helper()
+
+		db, err := NewDatastoreMergeToSize(dir, 200, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db.SetKeyring(k)
+
+		return db
+	}
+
+	check := func(t *testing.T, db *Datastore, n int) {
+		t.Helper()
+
+		for i := 0; i < n; i++ {
+			value, err := db.Get(fmt.Sprintf("key%d", i))
+			if err != nil || string(value) != fmt.Sprintf("secret%d", i) {
+				t.Errorf("can't get key%d: %s, %v", i, value, err)
+			}
+		}
+	}
+
+	db := open(t, keyring(t, testKey1))
+
+	for i := 0; i < 10; i++ {
+		if err = db.Put(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("secret%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("ciphertext", func(t *testing.T) {
+		files, err := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, path := range files {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if bytes.Contains(data, []byte("secret")) {
+				t.Errorf("%s holds plaintext values", path)
+			}
+		}
+
+		check(t, db, 10)
+	})
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("reopen", func(t *testing.T) {
+		db = open(t, keyring(t, testKey1))
+		check(t, db, 10)
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		db.SetKeyring(keyring(t, testKey1+","+testKey2))
+
+		if err = db.Put("key0", []byte("secret0")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = db.merge(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Both the merged segments and the active one are on the new key now.
+		db = open(t, keyring(t, testKey2))
+		check(t, db, 10)
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		db.SetKeyring(keyring(t, testKey1))
+
+		if _, err = db.Get("key1"); !errors.Is(err, ErrUnknownKey) {
+			t.Errorf("expected %s, got %v", ErrUnknownKey, err)
+		}
+	})
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("tampered", func(t *testing.T) {
+		files, err := filepath.Glob(filepath.Join(dir, segmentPrefix+"[0-9]*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, path := range files {
+			if strings.HasSuffix(path, hintSuffix) || strings.HasSuffix(path, bloomSuffix) {
+				continue
+			}
+
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Flip a byte of every value and fix the record checksums up, so
+			// that only the authentication can tell. Values of overwritten
+			// keys are never read, so tampering with one record is not enough.
+			for offset := 0; offset < len(data); {
+				size := int(binary.LittleEndian.Uint32(data[offset:]))
+				record := data[offset : offset+size]
+
+				if record[8] == entryPut {
+					record[size-1] ^= 1
+					binary.LittleEndian.PutUint32(record[4:], checksum(record))
+				}
+
+				offset += size
+			}
+
+			if err = ioutil.WriteFile(path, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		db = open(t, keyring(t, testKey2))
+
+		defer func(db *Datastore) {
+			_ = db.Close()
+		}(db)
+
+		failed := false
+
+		for i := 0; i < 10; i++ {
+			if _, err = db.Get(fmt.Sprintf("key%d", i)); errors.Is(err, ErrCorruptedFile) {
+				failed = true
+			}
+		}
+
+		if !failed {
+			t.Error("tampered value was decrypted")
+		}
+	})
+}
@@ -2,79 +2,205 @@ package datastore
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
-	"fmt"
+	"errors"
+	"hash/crc32"
+	"io"
+	"time"
 )
 
+const (
+	entryPut byte = iota
+	entryDelete
+	entryBatch
+	// entryHeader starts a compressed or encrypted segment.
+	entryHeader
+)
+
+// entryHeaderSize covers the size, checksum, kind, sequence number, version,
+// expiry time and both length fields.
+const entryHeaderSize = 41
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 type entry struct {
-	key   string
-	value []byte
+	kind byte
+	seq  uint64
+	// version counts the writes of the key, tombstones included.
+	version uint64
+	key     string
+	value   []byte
+	// expires is a Unix time in nanoseconds, zero for entries that never expire.
+	expires int64
 }
 
+// Encode lays the entry out as size, CRC32C, kind, sequence number, version,
+// expiry time, key length, key, value length and value. The checksum covers
+// every byte of the record but itself.
 func (e *entry) Encode() []byte {
 	kl := len(e.key)
 	vl := len(e.value)
-	size := kl + vl + 12
+	size := kl + vl + entryHeaderSize
 	res := make([]byte, size)
 
 	binary.LittleEndian.PutUint32(res, uint32(size))
-	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
-	copy(res[8:], e.key)
-	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
-	copy(res[kl+12:], e.value)
+	res[8] = e.kind
+	binary.LittleEndian.PutUint64(res[9:], e.seq)
+	binary.LittleEndian.PutUint64(res[17:], e.version)
+	binary.LittleEndian.PutUint64(res[25:], uint64(e.expires))
+	binary.LittleEndian.PutUint32(res[33:], uint32(kl))
+	copy(res[37:], e.key)
+	binary.LittleEndian.PutUint32(res[kl+37:], uint32(vl))
+	copy(res[kl+41:], e.value)
+	binary.LittleEndian.PutUint32(res[4:], checksum(res))
 
 	return res
 }
 
-func (e *entry) Decode(input []byte) {
-	kl := binary.LittleEndian.Uint32(input[4:])
+func (e *entry) Decode(input []byte) error {
+	if len(input) < entryHeaderSize || int(binary.LittleEndian.Uint32(input)) != len(input) {
+		return ErrCorruptedFile
+	}
+
+	if binary.LittleEndian.Uint32(input[4:]) != checksum(input) {
+		return ErrCorruptedFile
+	}
+
+	kl := binary.LittleEndian.Uint32(input[33:])
+	if uint64(kl)+entryHeaderSize > uint64(len(input)) {
+		return ErrCorruptedFile
+	}
+
+	vl := binary.LittleEndian.Uint32(input[kl+37:])
+	if uint64(kl)+uint64(vl)+entryHeaderSize != uint64(len(input)) {
+		return ErrCorruptedFile
+	}
+
+	e.kind = input[8]
+	e.seq = binary.LittleEndian.Uint64(input[9:])
+	e.version = binary.LittleEndian.Uint64(input[17:])
+	e.expires = int64(binary.LittleEndian.Uint64(input[25:]))
+
 	keyBuf := make([]byte, kl)
 
-	copy(keyBuf, input[8:kl+8])
+	copy(keyBuf, input[37:kl+37])
 
 	e.key = string(keyBuf)
 
-	vl := binary.LittleEndian.Uint32(input[kl+8:])
 	valBuf := make([]byte, vl)
 
-	copy(valBuf, input[kl+12:kl+12+vl])
+	copy(valBuf, input[kl+41:kl+41+vl])
 
 	e.value = valBuf
+
+	return nil
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return e.expires != 0 && now.UnixNano() >= e.expires
 }
 
-func readValue(in *bufio.Reader) ([]byte, error) {
-	header, err := in.Peek(8)
+func checksum(record []byte) uint32 {
+	crc := crc32.Update(0, crcTable, record[:4])
+
+	return crc32.Update(crc, crcTable, record[8:])
+}
+
+// readEntry reads and verifies a single record, returning it together with
+// its size on disk. A clean end of input is reported as io.EOF, while a
+// record cut short or failing its checksum yields ErrCorruptedFile.
+func readEntry(in *bufio.Reader) (*entry, int, error) {
+	header, err := in.Peek(4)
+	if errors.Is(err, io.EOF) && len(header) > 0 {
+		return nil, 0, ErrCorruptedFile
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	size := int(binary.LittleEndian.Uint32(header))
+	if size < entryHeaderSize {
+		return nil, 0, ErrCorruptedFile
+	}
+
+	data, err := readRecord(in, size)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
+	var e entry
 
-	if _, err = in.Discard(keySize + 8); err != nil {
-		return nil, err
+	if err = e.Decode(data); err != nil {
+		return nil, 0, err
+	}
+
+	return &e, size, nil
+}
+
+// readEntryAt reads and verifies the record at position without going
+// through a shared file offset, so concurrent readers may use one file.
+func readEntryAt(in io.ReaderAt, position int64) (*entry, int, error) {
+	header := make([]byte, 4)
+
+	n, err := in.ReadAt(header, position)
+	if errors.Is(err, io.EOF) && n > 0 {
+		return nil, 0, ErrCorruptedFile
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	size := int(binary.LittleEndian.Uint32(header))
+	if size < entryHeaderSize {
+		return nil, 0, ErrCorruptedFile
 	}
 
-	header, err = in.Peek(4)
+	data, err := readRecord(io.NewSectionReader(in, position, int64(size)), size)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	valSize := int(binary.LittleEndian.Uint32(header))
+	var e entry
 
-	if _, err = in.Discard(4); err != nil {
-		return nil, err
+	if err = e.Decode(data); err != nil {
+		return nil, 0, err
 	}
 
-	data := make([]byte, valSize)
+	return &e, size, nil
+}
 
-	n, err := in.Read(data)
-	if err != nil {
-		return nil, err
+// readRecord reads a record of the given size. The size is not verified yet,
+// so large records are buffered as their bytes arrive: a damaged size field
+// can't allocate more than the input holds.
+func readRecord(in io.Reader, size int) ([]byte, error) {
+	if size > bufferSize {
+		var buf bytes.Buffer
+
+		if _, err := io.CopyN(&buf, in, int64(size)); errors.Is(err, io.EOF) {
+			return nil, ErrCorruptedFile
+		} else if err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
 	}
 
-	if n != valSize {
-		return nil, fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+	data := make([]byte, size)
+
+	if _, err := io.ReadFull(in, data); errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return nil, ErrCorruptedFile
+	} else if err != nil {
+		return nil, err
 	}
 
 	return data, nil
-}
\ No newline at end of file
+}
+
+// live returns the value of a put entry or errDeleted for tombstones. An
+// expired entry hides older values of the key just like a tombstone.
+func (e *entry) live(now time.Time) ([]byte, error) {
+	if e.kind == entryDelete || e.expired(now) {
+		return nil, errDeleted
+	}
+
+	return e.value, nil
+}
@@ -3,14 +3,26 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"runtime"
 	"testing"
+	"time"
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", []byte("value")}
+	e := entry{seq: 42, version: 7, key: "key", value: []byte("value")}
 
 	e.Decode(e.Encode())
 
+	if e.seq != 42 {
+		t.Error("incorrect sequence number")
+	}
+
+	if e.version != 7 {
+		t.Error("incorrect version")
+	}
+
 	if e.key != "key" {
 		t.Error("incorrect key")
 	}
@@ -20,11 +32,16 @@ func TestEntry_Encode(t *testing.T) {
 	}
 }
 
-func TestReadValue(t *testing.T) {
-	e := entry{"key", []byte("value")}
+func TestReadEntry(t *testing.T) {
+	e := entry{key: "key", value: []byte("value")}
 	data := e.Encode()
 
-	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
+	read, _, err := readEntry(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := read.live(time.Now())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -33,3 +50,60 @@ func TestReadValue(t *testing.T) {
 		t.Errorf("Got bat value [%s]", v)
 	}
 }
+
+func TestReadEntry_Deleted(t *testing.T) {
+	e := entry{kind: entryDelete, key: "key"}
+	data := e.Encode()
+
+	read, _, err := readEntry(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = read.live(time.Now()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected %s, got %v", ErrNotFound, err)
+	}
+}
+
+func TestEntry_Checksum(t *testing.T) {
+	data := (&entry{key: "key", value: []byte("value")}).Encode()
+
+	for i := range data {
+		corrupted := make([]byte, len(data))
+		copy(corrupted, data)
+		corrupted[i] ^= 0x10
+
+		var e entry
+
+		if err := e.Decode(corrupted); !errors.Is(err, ErrCorruptedFile) {
+			t.Errorf("flipped byte %d: expected %s, got %v", i, ErrCorruptedFile, err)
+		}
+
+		if _, _, err := readEntry(bufio.NewReader(bytes.NewReader(corrupted))); !errors.Is(err, ErrCorruptedFile) {
+			t.Errorf("flipped byte %d: expected %s from readEntry, got %v", i, ErrCorruptedFile, err)
+		}
+	}
+}
+
+func TestReadEntry_DamagedSize(t *testing.T) {
+	data := (&entry{key: "key", value: []byte("value")}).Encode()
+	binary.LittleEndian.PutUint32(data, 0xfffffff0)
+
+	var before, after runtime.MemStats
+
+	runtime.ReadMemStats(&before)
+
+	if _, _, err := readEntry(bufio.NewReader(bytes.NewReader(data))); !errors.Is(err, ErrCorruptedFile) {
+		t.Errorf("expected %s, got %v", ErrCorruptedFile, err)
+	}
+
+	if _, _, err := readEntryAt(bytes.NewReader(data), 0); !errors.Is(err, ErrCorruptedFile) {
+		t.Errorf("expected %s from readEntryAt, got %v", ErrCorruptedFile, err)
+	}
+
+	runtime.ReadMemStats(&after)
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("allocated %d bytes for a %d byte record", allocated, len(data))
+	}
+}
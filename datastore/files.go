@@ -0,0 +1,156 @@
+package datastore
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const maxOpenFiles = 64
+
+// openFile is a segment file shared by concurrent readers. An evicted file is
+// closed once the last reader releases it.
+type openFile struct {
+	seg     *segment
+	file    *os.File
+	refs    int
+	evicted bool
+}
+
+// fileCache keeps the files of recently read segments open, closing the
+// least recently used ones past its capacity. Files are keyed by segment
+// rather than path, so a handle survives the active segment being sealed.
+type fileCache struct {
+	mutex    sync.Mutex
+	capacity int
+	files    map[*segment]*list.Element
+	lru      *list.List
+}
+
+func newFileCache(capacity int) *fileCache {
+	return &fileCache{
+		capacity: capacity,
+		files:    make(map[*segment]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// acquire returns the open file of a segment, calling open on a miss. Every
+// acquired file has to be released.
+func (c *fileCache) acquire(seg *segment, open func() (*os.File, error)) (*openFile, error) {
+	c.mutex.Lock()
+
+	if el, ok := c.files[seg]; ok {
+		c.lru.MoveToFront(el)
+
+		of := el.Value.(*openFile)
+		of.refs++
+		c.mutex.Unlock()
+
+		return of, nil
+	}
+
+	c.mutex.Unlock()
+
+	file, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.files[seg]; ok {
+		_ = file.Close()
+
+		c.lru.MoveToFront(el)
+
+		of := el.Value.(*openFile)
+		of.refs++
+
+		return of, nil
+	}
+
+	of := &openFile{seg: seg, file: file, refs: 1}
+
+	// Files of merged segments would only keep removed data on disk.
+	if c.capacity == 0 || atomic.LoadInt32(&seg.obsolete) == 1 {
+		of.evicted = true
+
+		return of, nil
+	}
+
+	c.files[seg] = c.lru.PushFront(of)
+	c.shrink(c.capacity)
+
+	return of, nil
+}
+
+func (c *fileCache) release(of *openFile) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	of.refs--
+	if of.refs == 0 && of.evicted {
+		_ = of.file.Close()
+	}
+}
+
+// evict drops the file of a segment from the cache.
+func (c *fileCache) evict(seg *segment) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.files[seg]; ok {
+		c.remove(el)
+	}
+}
+
+// resize changes the number of files kept open, zero disables caching.
+func (c *fileCache) resize(capacity int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.capacity = capacity
+	c.shrink(capacity)
+}
+
+// len returns the number of cached files.
+func (c *fileCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.lru.Len()
+}
+
+func (c *fileCache) shrink(capacity int) {
+	for c.lru.Len() > capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *fileCache) remove(el *list.Element) {
+	of := el.Value.(*openFile)
+
+	c.lru.Remove(el)
+	delete(c.files, of.seg)
+
+	of.evicted = true
+	if of.refs == 0 {
+		_ = of.file.Close()
+	}
+}
+
+// SetMaxOpenFiles bounds the number of segment files kept open for reads.
+// With zero every read opens the segment file anew.
+func (db *Datastore) SetMaxOpenFiles(n int) error {
+	if n < 0 {
+		return fmt.Errorf("max open files must not be negative, got %d", n)
+	}
+
+	db.files.resize(n)
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDatastore_FileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(db *Datastore) {
+		_ = db.Close()
+	}(db)
+
+	if err = db.SetMaxOpenFiles(2); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, val := range bigDataset {
+		if err = db.Put(key, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("bounded", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			for key, val := range bigDataset {
+				value, err := db.Get(key)
+				if err != nil {
+					t.Fatalf("can't get %s: %v", key, err)
+				}
+
+				if string(value) != string(val) {
+					t.Errorf("bad value for %s: got %s, want %s", key, value, val)
+				}
+			}
+		}
+
+		if n := db.files.len(); n != 2 {
+			t.Errorf("%d files are open, want 2", n)
+		}
+	})
+
+	t.Run("sealed", func(t *testing.T) {
+		// The cached handle of the active segment keeps working once it is
+		// renamed.
+		if err = db.Put("sealed", []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = db.Get("sealed"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = db.addSegment(); err != nil {
+			t.Fatal(err)
+		}
+
+		value, err := db.Get("sealed")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(value) != "value" {
+			t.Errorf("bad value: got %s", value)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		if err = db.SetMaxOpenFiles(0); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = db.Get("key1"); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := db.files.len(); n != 0 {
+			t.Errorf("%d files are open, want none", n)
+		}
+
+		if err = db.SetMaxOpenFiles(-1); err == nil {
+			t.Error("negative limit accepted")
+		}
+	})
+}
+
+func BenchmarkDatastore_Get(b *testing.B) {
+	for _, bc := range []struct {
+		name     string
+		maxFiles int
+	}{
+		{"open-per-read", 0},
+		{"cached", maxOpenFiles},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "bench-db")
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			defer func(path string) {
+				_ = os.RemoveAll(path)
+			}(dir)
+
+			db, err := NewDatastoreMergeToSize(dir, 64*1024, false)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			defer func(db *Datastore) {
+				_ = db.Close()
+			}(db)
+
+			if err = db.SetMaxOpenFiles(bc.maxFiles); err != nil {
+				b.Fatal(err)
+			}
+
+			const keys = 10000
+
+			for i := 0; i < keys; i++ {
+				if err = db.Put(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i))); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err = db.Get(fmt.Sprintf("key%d", i%keys)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
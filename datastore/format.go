@@ -0,0 +1,165 @@
+package datastore
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// format is how the values of a segment are stored. Segments in any other
+// format than plaintext start with a header record naming it, so the ones
+// written before compression or encryption was turned on still load. Merged
+// segments always start with one, see setHeader.
+type format struct {
+	codec Codec
+	keyID string
+}
+
+// segmentHeader is the first record of a segment that is not plaintext, its
+// key is the codec and its value the encryption key id.
+func segmentHeader(f format) *entry {
+	return &entry{kind: entryHeader, key: string(f.codec), value: []byte(f.keyID)}
+}
+
+// setHeader reads the header record of a segment, which counts as live data
+// since merge writes it again. Merge keeps the highest sequence number and
+// version of the records it drops in the header ones.
+func (s *segment) setHeader(e *entry, size int) {
+	s.format = format{codec: Codec(e.key), keyID: string(e.value)}
+	s.horizon = e.seq
+	s.floor = e.version
+	s.live += int64(size)
+}
+
+// encode returns the record of an entry as stored in a segment of the
+// format. Values are compressed before they are encrypted.
+func (f format) encode(k *Keyring, e *entry) ([]byte, error) {
+	if f == (format{}) || (e.kind != entryPut && e.kind != entryDelete) {
+		return e.Encode(), nil
+	}
+
+	var err error
+
+	stored := *e
+
+	if f.codec != NoCompression && e.kind == entryPut {
+		if stored.value, err = compress(f.codec, stored.value); err != nil {
+			return nil, err
+		}
+	}
+
+	if f.keyID != "" {
+		if stored.value, err = k.encrypt(f.keyID, e.key, stored.value); err != nil {
+			return nil, err
+		}
+	}
+
+	return stored.Encode(), nil
+}
+
+// decode restores the value of an entry read from a segment of the format.
+func (f format) decode(k *Keyring, e *entry) error {
+	if f == (format{}) || (e.kind != entryPut && e.kind != entryDelete) {
+		return nil
+	}
+
+	var err error
+
+	if f.keyID != "" {
+		if e.value, err = k.decrypt(f.keyID, e.key, e.value); err != nil {
+			return err
+		}
+	}
+
+	if f.codec != NoCompression && e.kind == entryPut {
+		if e.value, err = decompress(f.codec, e.key, e.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decode restores the value of an entry read from a segment.
+func (db *Datastore) decode(seg *segment, e *entry) error {
+	db.mutex.RLock()
+	k, f := db.keyring, seg.format
+	db.mutex.RUnlock()
+
+	return f.decode(k, e)
+}
+
+// format returns the format new segments are written in, it has to be called
+// with the mutex held.
+func (db *Datastore) format() format {
+	f := format{codec: db.compression}
+
+	if db.keyring != nil {
+		f.keyID = db.keyring.active
+	}
+
+	return f
+}
+
+// rotate makes sure the active segment is in the configured format, sealing
+// it if it holds records written in another one, and returns the keyring
+// and format to write with. It runs on the writer goroutine.
+func (db *Datastore) rotate() (*Keyring, format, error) {
+	db.mutex.RLock()
+	keyring, f := db.keyring, db.format()
+	current, size := db.segments[0].format, db.segments[0].offset
+	db.mutex.RUnlock()
+
+	if current == f {
+		return keyring, f, nil
+	}
+
+	if size > 0 {
+		if _, err := db.addSegment(); err != nil {
+			return nil, format{}, err
+		}
+
+		if f == (format{}) {
+			return keyring, f, nil
+		}
+	}
+
+	n, err := db.out.Write(segmentHeader(f).Encode())
+	if err != nil {
+		return nil, format{}, err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.segments[0].format = f
+	db.segments[0].offset += int64(n)
+	db.segments[0].live += int64(n)
+
+	return keyring, f, nil
+}
+
+// readHeader sets the format of a segment loaded from a hint file.
+func (s *segment) readHeader() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	e, n, err := readEntryAt(f, 0)
+	if errors.Is(err, io.EOF) {
+		return nil
+	} else if err != nil {
+		return corrupted(s.path, 0, err)
+	}
+
+	if e.kind == entryHeader {
+		s.setHeader(e, n)
+	}
+
+	return nil
+}
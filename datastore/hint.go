@@ -0,0 +1,134 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const hintSuffix = ".hint"
+
+// hintHeaderSize covers the segment size, its sequence number and the number
+// of keys in the hint file.
+const hintHeaderSize = 20
+
+var errInvalidHint = errors.New("invalid hint file")
+
+// writeHint stores the index of a sealed segment next to it, so that it can
+// be loaded on open without reading the whole segment. The hint file holds
+// the header followed by key length, key, offset and record size for every
+// key and ends with a CRC32C of all of that.
+func (s *segment) writeHint() error {
+	data := make([]byte, hintHeaderSize, hintHeaderSize+len(s.index)*20)
+
+	binary.LittleEndian.PutUint64(data, uint64(s.offset))
+	binary.LittleEndian.PutUint64(data[8:], s.seq)
+	binary.LittleEndian.PutUint32(data[16:], uint32(len(s.index)))
+
+	var buf [8]byte
+
+	for key, pos := range s.index {
+		binary.LittleEndian.PutUint32(buf[:], uint32(len(key)))
+		data = append(data, buf[:4]...)
+		data = append(data, key...)
+		binary.LittleEndian.PutUint64(buf[:], uint64(pos.offset))
+		data = append(data, buf[:]...)
+		binary.LittleEndian.PutUint32(buf[:], uint32(pos.size))
+		data = append(data, buf[:4]...)
+	}
+
+	binary.LittleEndian.PutUint32(buf[:], crc32.Checksum(data, crcTable))
+	data = append(data, buf[:4]...)
+
+	return ioutil.WriteFile(s.path+hintSuffix, data, 0o600)
+}
+
+// loadHint fills the index from the hint file, it fails when the file is
+// missing, damaged or was written for a segment of another size.
+func (s *segment) loadHint() error {
+	data, err := ioutil.ReadFile(s.path + hintSuffix)
+	if err != nil {
+		return err
+	}
+
+	if len(data) < hintHeaderSize+4 {
+		return errInvalidHint
+	}
+
+	body := data[:len(data)-4]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return errInvalidHint
+	}
+
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	size := int64(binary.LittleEndian.Uint64(body))
+	if size != fi.Size() {
+		return errInvalidHint
+	}
+
+	seq := binary.LittleEndian.Uint64(body[8:])
+	count := int(binary.LittleEndian.Uint32(body[16:]))
+	index := make(hashIndex, count)
+	rest := body[hintHeaderSize:]
+
+	for i := 0; i < count; i++ {
+		if len(rest) < 4 {
+			return errInvalidHint
+		}
+
+		kl := int(binary.LittleEndian.Uint32(rest))
+		if len(rest) < kl+16 {
+			return errInvalidHint
+		}
+
+		index[string(rest[4:kl+4])] = position{
+			offset: int64(binary.LittleEndian.Uint64(rest[kl+4:])),
+			size:   int64(binary.LittleEndian.Uint32(rest[kl+12:])),
+		}
+		rest = rest[kl+16:]
+	}
+
+	if len(rest) != 0 {
+		return errInvalidHint
+	}
+
+	s.index = index
+	s.offset = size
+	s.seq = seq
+
+	return nil
+}
+
+// load restores a sealed segment from its hint file, falling back to reading
+// the segment itself. Like restore it reports success with io.EOF.
+func (s *segment) load() error {
+	err := s.loadHint()
+	if err == nil {
+		if err = s.readHeader(); err != nil {
+			return err
+		}
+
+		return io.EOF
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		s.logf("can't use hint file of %s: %v", s.path, err)
+	}
+
+	if err = s.restore(); !errors.Is(err, io.EOF) || s.readOnly {
+		return err
+	}
+
+	if err := s.writeHint(); err != nil {
+		s.logf("can't write hint file of %s: %v", s.path, err)
+	}
+
+	return err
+}
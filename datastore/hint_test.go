@@ -0,0 +1,158 @@
+package datastore
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSegment_Hint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range sortedKeys(bigDataset) {
+		if err = db.Put(key, bigDataset[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.addSegment(); err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := db.segments[1]
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	scanned := func() *segment {
+		s := &segment{path: sealed.path, index: make(hashIndex)}
+		if err := s.restore(); !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	t.Run("load", func(t *testing.T) {
+		s := &segment{path: sealed.path}
+		if err = s.loadHint(); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := scanned()
+		if !reflect.DeepEqual(s.index, expected.index) || s.offset != expected.offset || s.seq != expected.seq {
+			t.Errorf("hint does not match the segment: %v, %d, %d", s.index, s.offset, s.seq)
+		}
+	})
+
+	t.Run("damaged hint", func(t *testing.T) {
+		data, err := ioutil.ReadFile(sealed.path + hintSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data[hintHeaderSize] ^= 0xff
+
+		if err = ioutil.WriteFile(sealed.path+hintSuffix, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		s := &segment{path: sealed.path, index: make(hashIndex)}
+		if err = s.loadHint(); !errors.Is(err, errInvalidHint) {
+			t.Errorf("expected %s, got %v", errInvalidHint, err)
+		}
+
+		if err = s.load(); !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(s.index, scanned().index) {
+			t.Errorf("unexpected index after a full scan: %v", s.index)
+		}
+
+		if err = (&segment{path: sealed.path}).loadHint(); err != nil {
+			t.Errorf("hint file was not rewritten: %s", err)
+		}
+	})
+
+	t.Run("stale hint", func(t *testing.T) {
+		f, err := os.OpenFile(sealed.path, os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = f.Write((&entry{seq: 100, key: "key13", value: []byte("credit")}).Encode()); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		s := &segment{path: sealed.path, index: make(hashIndex)}
+		if err = s.loadHint(); !errors.Is(err, errInvalidHint) {
+			t.Errorf("expected %s, got %v", errInvalidHint, err)
+		}
+
+		if err = s.load(); !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+
+		if _, ok := s.index["key13"]; !ok || s.seq != 100 {
+			t.Error("stale hint file was used")
+		}
+	})
+
+	t.Run("open", func(t *testing.T) {
+		data, err := ioutil.ReadFile(sealed.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Damaging a value is only noticed by a full scan of the segment.
+		data[len(data)-1] ^= 0xff
+
+		if err = ioutil.WriteFile(sealed.path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if db, err = NewDatastore(dir); err != nil {
+			t.Fatalf("segment was scanned despite a valid hint file: %s", err)
+		}
+
+		if err = db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = os.Remove(sealed.path + hintSuffix); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = NewDatastore(dir); !errors.Is(err, ErrCorruptedFile) {
+			t.Errorf("expected %s without a hint file, got %v", ErrCorruptedFile, err)
+		}
+	})
+}
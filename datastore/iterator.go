@@ -0,0 +1,87 @@
+package datastore
+
+import (
+	"errors"
+	"sort"
+)
+
+// Iterator walks keys in ascending order together with their latest values.
+// Keys are collected when the iterator is created, values are read lazily
+// and keys deleted in the meantime are skipped.
+type Iterator struct {
+	get  func(key string) ([]byte, error)
+	keys []string
+
+	key   string
+	value []byte
+	err   error
+}
+
+// Scan iterates over keys in the [start, end) range. An empty end leaves the
+// range unbounded. Keys of buckets are left out.
+func (db *Datastore) Scan(start, end string) *Iterator {
+	v := db.pin(false)
+	defer v.release()
+
+	return &Iterator{get: db.Get, keys: v.keys(withoutBuckets(start), end)}
+}
+
+// Prefix iterates over keys starting with p.
+func (db *Datastore) Prefix(p string) *Iterator {
+	return db.Scan(p, prefixEnd(p))
+}
+
+// prefixEnd returns the smallest key greater than every key starting with p,
+// or an empty string when there is no such key.
+func prefixEnd(p string) string {
+	end := []byte(p)
+
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+
+			return string(end[:i+1])
+		}
+	}
+
+	return ""
+}
+
+// Seek skips the keys less than key.
+func (it *Iterator) Seek(key string) {
+	it.keys = it.keys[sort.SearchStrings(it.keys, key):]
+}
+
+func (it *Iterator) Next() bool {
+	for it.err == nil && len(it.keys) > 0 {
+		key := it.keys[0]
+		it.keys = it.keys[1:]
+
+		value, err := it.get(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			it.err = err
+
+			return false
+		}
+
+		it.key, it.value = key, value
+
+		return true
+	}
+
+	return false
+}
+
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,127 @@
+package datastore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDatastore_Scan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 44, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, val := range bigDataset {
+		if err = db.Put(key, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = db.Put("key2", []byte("father")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Delete("key3"); err != nil {
+		t.Fatal(err)
+	}
+
+	collect := func(it *Iterator) []string {
+		var keys []string
+
+		for it.Next() {
+			expected := bigDataset[it.Key()]
+			if it.Key() == "key2" {
+				expected = []byte("father")
+			}
+
+			if !bytes.Equal(it.Value(), expected) {
+				t.Errorf("wrong value returned for %s expected %s, got %s", it.Key(), expected, it.Value())
+			}
+
+			keys = append(keys, it.Key())
+		}
+
+		if err := it.Err(); err != nil {
+			t.Error(err)
+		}
+
+		return keys
+	}
+
+	for _, test := range []struct {
+		name     string
+		it       *Iterator
+		expected []string
+	}{
+		{
+			name:     "range",
+			it:       db.Scan("key10", "key5"),
+			expected: []string{"key10", "key11", "key12", "key2", "key4"},
+		},
+		{
+			name: "unbounded",
+			it:   db.Scan("key6", ""),
+			expected: []string{
+				"key6", "key7", "key8", "key9",
+			},
+		},
+		{
+			name:     "prefix",
+			it:       db.Prefix("key1"),
+			expected: []string{"key1", "key10", "key11", "key12"},
+		},
+		{
+			name: "seek",
+			it: func() *Iterator {
+				it := db.Prefix("key1")
+				it.Seek("key10\x00")
+
+				return it
+			}(),
+			expected: []string{"key11", "key12"},
+		},
+		{
+			name: "missing prefix",
+			it:   db.Prefix("user:"),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if keys := collect(test.it); !reflect.DeepEqual(keys, test.expected) {
+				t.Errorf("unexpected keys %v instead of %v", keys, test.expected)
+			}
+		})
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for p, expected := range map[string]string{
+		"":         "",
+		"user:":    "user;",
+		"a\xff":    "b",
+		"\xff\xff": "",
+		"key\xffz": "key\xff{",
+	} {
+		if end := prefixEnd(p); end != expected {
+			t.Errorf("prefixEnd(%q) = %q, expected %q", p, end, expected)
+		}
+	}
+}
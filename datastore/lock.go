@@ -0,0 +1,52 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+const lockFileName = "LOCK"
+
+// ErrLocked is returned by Open when another process has the datastore open.
+var ErrLocked = errors.New("datastore is locked by another process")
+
+// lockDir takes an advisory lock on the LOCK file of a datastore, a shared one
+// for read-only access. Read-only datastores do not create the file, so one
+// that has never been opened for writing is not locked.
+func lockDir(dir string, shared bool) (*os.File, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if shared {
+		flag = os.O_RDONLY
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, lockFileName), flag, 0o600)
+	if shared && errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = lockFile(f, shared); err != nil {
+		_ = f.Close()
+
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// unlockDir releases a lock taken by lockDir.
+func unlockDir(f *os.File) error {
+	if f == nil {
+		return nil
+	}
+
+	if err := unlockFile(f); err != nil {
+		_ = f.Close()
+
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,74 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestOpen_Lock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("exclusive", func(t *testing.T) {
+		if _, err = NewDatastoreMergeToSize(dir, 100, false); !errors.Is(err, ErrLocked) {
+			t.Errorf("expected %s, got %v", ErrLocked, err)
+		}
+
+		if _, err = Open(dir, ReadOnly()); !errors.Is(err, ErrLocked) {
+			t.Errorf("expected %s for a reader, got %v", ErrLocked, err)
+		}
+	})
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("shared", func(t *testing.T) {
+		var readers []*Datastore
+
+		for i := 0; i < 2; i++ {
+			reader, err := Open(dir, ReadOnly())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			readers = append(readers, reader)
+		}
+
+		if _, err = Open(dir); !errors.Is(err, ErrLocked) {
+			t.Errorf("expected %s with readers, got %v", ErrLocked, err)
+		}
+
+		for _, reader := range readers {
+			if err = reader.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("released", func(t *testing.T) {
+		if db, err = Open(dir); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
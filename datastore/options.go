@@ -0,0 +1,133 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ErrReadOnly is returned by writes to a datastore opened with ReadOnly.
+var ErrReadOnly = errors.New("datastore is read-only")
+
+// Logger receives the messages of a datastore, *log.Logger is one.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Option configures a datastore opened with Open.
+type Option func(o *options)
+
+type options struct {
+	segmentSize     int64
+	compaction      CompactionPolicy
+	compactionSet   bool
+	readConcurrency int64
+	syncMode        SyncMode
+	syncInterval    time.Duration
+	logger          Logger
+	readOnly        bool
+}
+
+func defaultOptions() options {
+	return options{
+		segmentSize:     maxBlockSize,
+		compaction:      MergeAll{},
+		readConcurrency: maxReadThreads,
+		syncMode:        SyncNever,
+		logger:          stdLogger{},
+	}
+}
+
+// stdLogger writes to the standard logger.
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// WithSegmentSize sets the size the active segment is sealed at.
+func WithSegmentSize(size int64) Option {
+	return func(o *options) {
+		o.segmentSize = size
+	}
+}
+
+// WithCompactionPolicy sets the policy merges follow, nil turns them off.
+// All sealed segments are merged together by default.
+func WithCompactionPolicy(p CompactionPolicy) Option {
+	return func(o *options) {
+		o.compaction = p
+		o.compactionSet = true
+	}
+}
+
+// WithReadConcurrency limits the number of reads served at once.
+func WithReadConcurrency(n int) Option {
+	return func(o *options) {
+		o.readConcurrency = int64(n)
+	}
+}
+
+// WithSyncMode sets when writes are flushed to disk, see SetSyncMode.
+func WithSyncMode(mode SyncMode, interval time.Duration) Option {
+	return func(o *options) {
+		o.syncMode = mode
+		o.syncInterval = interval
+	}
+}
+
+// WithLogger sends the messages of the datastore to l instead of the
+// standard logger.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// ReadOnly opens the datastore without touching its files: writes fail with
+// ErrReadOnly, nothing is merged and a segment torn by a crash is read up to
+// the damage instead of being truncated.
+func ReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+func (o *options) validate() error {
+	if o.segmentSize <= 0 {
+		return fmt.Errorf("segment size must be positive, got %d", o.segmentSize)
+	}
+
+	if o.readConcurrency <= 0 {
+		return fmt.Errorf("read concurrency must be positive, got %d", o.readConcurrency)
+	}
+
+	switch o.syncMode {
+	case SyncNever, SyncAlways:
+	case SyncInterval:
+		if o.syncInterval <= 0 {
+			return fmt.Errorf("sync interval must be positive, got %v", o.syncInterval)
+		}
+	default:
+		return fmt.Errorf("unknown sync mode %v", o.syncMode)
+	}
+
+	if o.logger == nil {
+		return errors.New("logger must not be nil")
+	}
+
+	if o.readOnly {
+		if o.syncMode != SyncNever {
+			return fmt.Errorf("%w: can't sync in %v mode", ErrReadOnly, o.syncMode)
+		}
+
+		if o.compactionSet && o.compaction != nil {
+			return fmt.Errorf("%w: can't compact", ErrReadOnly)
+		}
+
+		o.compaction = nil
+	}
+
+	return nil
+}
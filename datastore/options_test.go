@@ -0,0 +1,183 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testLogger struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func TestOpen_Validation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	for name, opts := range map[string][]Option{
+		"segment size":       {WithSegmentSize(0)},
+		"read concurrency":   {WithReadConcurrency(-1)},
+		"sync interval":      {WithSyncMode(SyncInterval, 0)},
+		"sync mode":          {WithSyncMode(SyncMode(42), time.Second)},
+		"logger":             {WithLogger(nil)},
+		"read-only syncs":    {ReadOnly(), WithSyncMode(SyncAlways, 0)},
+		"read-only compacts": {ReadOnly(), WithCompactionPolicy(MergeAll{})},
+	} {
+		if db, err := Open(dir, opts...); err == nil {
+			_ = db.Close()
+
+			t.Errorf("%s: invalid options are accepted", name)
+		}
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("invalid options left %d files behind", len(files))
+	}
+
+	db, err := Open(
+		dir,
+		WithSegmentSize(100),
+		WithCompactionPolicy(nil),
+		WithReadConcurrency(1),
+		WithSyncMode(SyncInterval, time.Millisecond),
+		WithLogger(new(testLogger)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(db *Datastore) {
+		_ = db.Close()
+	}(db)
+
+	if mode, interval := db.SyncMode(); mode != SyncInterval || interval != time.Millisecond {
+		t.Errorf("sync mode is %v every %v", mode, interval)
+	}
+
+	if db.currentBlockSize != 100 || db.compaction != nil {
+		t.Errorf("segment size %d, compaction %v", db.currentBlockSize, db.compaction)
+	}
+}
+
+func TestOpen_ReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := Open(dir, WithSegmentSize(100), WithCompactionPolicy(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err = db.Put(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A torn write at the end of the active segment and a missing hint file.
+	active := filepath.Join(dir, segmentPrefix+currentSegmentSuffix)
+
+	f, err := os.OpenFile(active, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Write([]byte{0xff, 0xff}); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = f.Close()
+
+	hints, err := filepath.Glob(filepath.Join(dir, "*"+hintSuffix))
+	if err != nil || len(hints) == 0 {
+		t.Fatalf("no hint files: %v", err)
+	}
+
+	if err = os.Remove(hints[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	listing := func() string {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, fi := range files {
+			names = append(names, fmt.Sprintf("%s:%d", fi.Name(), fi.Size()))
+		}
+
+		return strings.Join(names, " ")
+	}
+
+	before := listing()
+	logger := new(testLogger)
+
+	db, err = Open(dir, WithSegmentSize(100), ReadOnly(), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if value, err := db.Get(fmt.Sprintf("key%d", i)); err != nil || string(value) != "value" {
+			t.Errorf("can't get key%d: %s, %v", i, value, err)
+		}
+	}
+
+	if err = db.Put("key0", []byte("other")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected %s, got %v", ErrReadOnly, err)
+	}
+
+	if err = db.SetSyncMode(SyncAlways, 0); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected %s, got %v", ErrReadOnly, err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if after := listing(); after != before {
+		t.Errorf("read-only open changed files from %s to %s", before, after)
+	}
+
+	if !strings.Contains(strings.Join(logger.messages, "\n"), "ignoring "+active) {
+		t.Errorf("torn write is not logged: %q", logger.messages)
+	}
+}
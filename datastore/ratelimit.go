@@ -0,0 +1,146 @@
+package datastore
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateLimiter is a token bucket holding up to a second worth of bytes. Callers
+// may take more than there is and wait for the debt to be paid off, which is
+// good enough for the single merging goroutine.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+	// changed is closed and replaced when the rate changes or the limiter is
+	// closed, waking waiters up to see if they still have to wait.
+	changed chan struct{}
+	closed  bool
+
+	bytes  int64
+	waited int64
+}
+
+// setRate changes the budget in bytes per second, zero lifts the limit.
+func (l *rateLimiter) setRate(rate int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.rate = rate
+	l.tokens = float64(rate)
+	l.last = time.Now()
+	l.wake()
+}
+
+func (l *rateLimiter) getRate() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.rate
+}
+
+// close lifts the limit for good, so that a merge still running when the
+// datastore is closed finishes right away.
+func (l *rateLimiter) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.closed = true
+	l.wake()
+}
+
+// wake has to be called with the mutex held.
+func (l *rateLimiter) wake() {
+	if l.changed != nil {
+		close(l.changed)
+	}
+
+	l.changed = make(chan struct{})
+}
+
+// wait accounts for n bytes of I/O, sleeping while the budget is exceeded.
+func (l *rateLimiter) wait(n int64) {
+	atomic.AddInt64(&l.bytes, n)
+
+	l.mutex.Lock()
+
+	if l.rate == 0 || l.closed {
+		l.mutex.Unlock()
+
+		return
+	}
+
+	l.refill()
+	l.tokens -= float64(n)
+	l.mutex.Unlock()
+
+	for {
+		l.mutex.Lock()
+
+		var delay time.Duration
+
+		if l.rate != 0 && !l.closed {
+			l.refill()
+
+			if l.tokens < 0 {
+				delay = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+			}
+		}
+
+		if l.changed == nil {
+			l.changed = make(chan struct{})
+		}
+
+		changed := l.changed
+		l.mutex.Unlock()
+
+		if delay <= 0 {
+			return
+		}
+
+		start := time.Now()
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		}
+
+		atomic.AddInt64(&l.waited, int64(time.Since(start)))
+	}
+}
+
+// refill adds the tokens earned since the last call, it has to be called with
+// the mutex held.
+func (l *rateLimiter) refill() {
+	now := time.Now()
+
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+
+	l.last = now
+}
+
+// SetCompactionRate limits reads and writes of background merges to the given
+// number of bytes per second, zero removes the limit.
+func (db *Datastore) SetCompactionRate(bytesPerSecond int64) error {
+	if bytesPerSecond < 0 {
+		return fmt.Errorf("compaction rate must not be negative, got %d", bytesPerSecond)
+	}
+
+	db.compactionLimiter.setRate(bytesPerSecond)
+
+	return nil
+}
+
+// CompactionRate returns the compaction budget in bytes per second, zero if
+// it is not limited.
+func (db *Datastore) CompactionRate() int64 {
+	return db.compactionLimiter.getRate()
+}
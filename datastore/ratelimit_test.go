@@ -0,0 +1,184 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+
+	start := time.Now()
+
+	l.wait(1 << 20)
+
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("unlimited wait took %v", elapsed)
+	}
+
+	l.setRate(10000)
+
+	start = time.Now()
+
+	// The bucket starts full, the rest takes a fifth of a second.
+	l.wait(10000)
+	l.wait(2000)
+
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("throttled wait took %v", elapsed)
+	}
+}
+
+func TestRateLimiter_Wake(t *testing.T) {
+	var l rateLimiter
+
+	waiting := func() chan struct{} {
+		done := make(chan struct{})
+
+		go func() {
+			// A debt of minutes at the rates below.
+			l.wait(100000)
+			close(done)
+		}()
+
+		time.Sleep(20 * time.Millisecond)
+
+		return done
+	}
+
+	finished := func(t *testing.T, done chan struct{}) {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("the wait went on")
+		}
+	}
+
+	t.Run("lifted", func(t *testing.T) {
+		l.setRate(100)
+		done := waiting()
+		l.setRate(0)
+		finished(t, done)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		l.setRate(1)
+		done := waiting()
+		l.close()
+		finished(t, done)
+	})
+}
+
+func TestDatastore_CompactionRate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(db *Datastore) {
+		_ = db.Close()
+	}(db)
+
+	if err = db.SetCompactionRate(-1); err == nil {
+		t.Error("negative rate accepted")
+	}
+
+	for key, val := range bigDataset {
+		if err = db.Put(key, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The dataset is read and written once, about 1200 bytes in total.
+	if err = db.SetCompactionRate(2000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.merge(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := db.Stats()
+	if stats.CompactionRate != 2000 || stats.CompactionBytes == 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	if err = db.SetCompactionRate(1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.addSegment(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.merge(); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats = db.Stats(); stats.CompactionThrottled == 0 {
+		t.Errorf("compaction was not throttled: %+v", stats)
+	}
+
+	for key, val := range bigDataset {
+		if value, err := db.Get(key); err != nil || string(value) != string(val) {
+			t.Errorf("can't get %s: %s, %v", key, value, err)
+		}
+	}
+}
+
+func TestDatastore_CloseThrottled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.SetCompactionRate(1); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, val := range bigDataset {
+		if err = db.Put(key, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for db.QuickStats().CompactionBytes == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("closing during a throttled merge took %v", elapsed)
+	}
+}
@@ -0,0 +1,244 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ErrHistoryTruncated is returned by Changes when merges have dropped records
+// the caller has not seen yet, or when the caller is ahead of the datastore,
+// so that it has to start over from a Dump.
+var ErrHistoryTruncated = errors.New("replication history truncated")
+
+// mark is the sequence number of the first record of a write and its offset
+// in the segment, letting Changes skip the records a follower already has.
+type mark struct {
+	seq    uint64
+	offset int64
+}
+
+// Seq returns the sequence number of the latest write.
+func (db *Datastore) Seq() uint64 {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.seq
+}
+
+// WaitForChanges blocks until a write with a sequence number above seq is
+// made or the context is done.
+func (db *Datastore) WaitForChanges(ctx context.Context, seq uint64) error {
+	for {
+		db.mutex.RLock()
+		latest, changed := db.seq, db.changed
+		db.mutex.RUnlock()
+
+		if latest > seq {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Changes writes every record with a sequence number above from to w, in the
+// order they were made, and returns the sequence number the output brings a
+// replica to. Overwritten records may be left out, since merges drop them.
+func (db *Datastore) Changes(from uint64, w io.Writer) (uint64, error) {
+	records, seq, err := db.changes(from)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, e := range records {
+		if _, err := w.Write(e.Encode()); err != nil {
+			return 0, err
+		}
+	}
+
+	return seq, nil
+}
+
+// changes returns the records following from ordered by sequence number.
+func (db *Datastore) changes(from uint64) ([]*entry, uint64, error) {
+	if from < atomic.LoadUint64(&db.horizon) {
+		return nil, 0, ErrHistoryTruncated
+	}
+
+	v := db.pin(false)
+	defer v.release()
+
+	if from > v.seq {
+		return nil, 0, ErrHistoryTruncated
+	}
+
+	var records []*entry
+
+	for i := len(v.segments) - 1; i >= 0; i-- {
+		seg := v.segments[i]
+
+		db.mutex.RLock()
+		seq, marks := seg.seq, seg.marks
+		db.mutex.RUnlock()
+
+		if seq <= from {
+			continue
+		}
+
+		var start int64
+
+		if n := sort.Search(len(marks), func(n int) bool { return marks[n].seq > from+1 }); n > 0 {
+			start = marks[n-1].offset
+		}
+
+		// The active segment may be sealed and renamed at any time, the file
+		// is opened under the mutex so that it is the one that was measured.
+		db.mutex.RLock()
+		size, path := seg.offset, seg.path
+		file, err := os.Open(path)
+		db.mutex.RUnlock()
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		found, err := recordsSince(file, path, from, start, size)
+
+		_ = file.Close()
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, e := range found {
+			if err = db.decode(seg, e); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		records = append(records, found...)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].seq < records[j].seq
+	})
+
+	// Writes made while the segments were read are there as well.
+	seq := v.seq
+	if len(records) > 0 && records[len(records)-1].seq > seq {
+		seq = records[len(records)-1].seq
+	}
+
+	return records, seq, nil
+}
+
+// recordsSince reads the records of a segment file between two offsets that
+// have sequence numbers above from.
+func recordsSince(file *os.File, path string, from uint64, start, end int64) ([]*entry, error) {
+	in := bufio.NewReaderSize(io.NewSectionReader(file, start, end-start), bufferSize)
+
+	var records []*entry
+
+	for offset := start; ; {
+		e, n, err := readEntry(in)
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		} else if err != nil {
+			return nil, corrupted(path, offset, err)
+		}
+
+		if (e.kind == entryPut || e.kind == entryDelete) && e.seq > from {
+			records = append(records, e)
+		}
+
+		offset += int64(n)
+	}
+}
+
+// Dump writes the latest record of every key that holds a value to w and
+// returns the sequence number of the last write it covers.
+func (db *Datastore) Dump(w io.Writer) (uint64, error) {
+	v := db.pin(true)
+	defer v.release()
+
+	now := time.Now()
+
+	for _, key := range v.keys("", "") {
+		e, err := v.lookup(key)
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err = e.live(now); err != nil {
+			continue
+		}
+
+		if _, err = w.Write(e.Encode()); err != nil {
+			return 0, err
+		}
+	}
+
+	return v.seq, nil
+}
+
+// Apply writes records produced by Changes on another datastore, keeping
+// their sequence numbers, versions and expiry times, and brings the sequence
+// number up to seq. Records the datastore already has are skipped. All of
+// them are written together, so that batches stay atomic.
+func (db *Datastore) Apply(data []byte, seq uint64) error {
+	entries, err := decodeRecords(data)
+	if err != nil {
+		return err
+	}
+
+	return db.replicate(putQuery{entries: entries, seq: seq})
+}
+
+// Load replaces the whole content of the datastore with records produced by
+// Dump on another one, setting the sequence number to seq.
+func (db *Datastore) Load(data []byte, seq uint64) error {
+	entries, err := decodeRecords(data)
+	if err != nil {
+		return err
+	}
+
+	return db.replicate(putQuery{entries: entries, seq: seq, reset: true})
+}
+
+func (db *Datastore) replicate(query putQuery) error {
+	query.replicated = true
+
+	return db.submit(query)
+}
+
+func decodeRecords(data []byte) ([]*entry, error) {
+	in := bufio.NewReader(bytes.NewReader(data))
+	entries := make([]*entry, 0)
+
+	for {
+		e, _, err := readEntry(in)
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid replicated records: %w", err)
+		}
+
+		if e.kind != entryPut && e.kind != entryDelete {
+			return nil, fmt.Errorf("invalid replicated records: %w", ErrCorruptedFile)
+		}
+
+		entries = append(entries, e)
+	}
+}
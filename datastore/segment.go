@@ -4,14 +4,20 @@ import (
 	"bufio"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 )
 
 const (
 	currentSegmentSuffix = ".current"
-	mergedSegmentSuffix  = ".merged"
 	segmentPrefix        = "segment."
 	bufferSize           = 8192
 )
@@ -20,6 +26,115 @@ type segment struct {
 	path   string
 	offset int64
 	index  hashIndex
+	// seq is the highest sequence number written to the segment. Sealed
+	// segments are ordered by it since merged ones get fresh file names.
+	seq uint64
+	// filter is set once the segment is sealed.
+	filter *bloomFilter
+	// live is the size of records not overwritten by newer ones, it is
+	// guarded by the datastore mutex.
+	live int64
+	// marks are kept for the writes made since the datastore was opened.
+	marks  []mark
+	logger Logger
+	// readOnly segments never get their hint and bloom files written.
+	readOnly bool
+
+	// format is set by the header record of compressed and encrypted
+	// segments.
+	format format
+	// horizon is the highest sequence number of a record merge dropped from
+	// the segment, or of the records a reset replaced. floor is above every
+	// version of the keys merge dropped, recreated keys start over from it.
+	horizon uint64
+	floor   uint64
+
+	// refs counts the readers and snapshots that pinned the segment, the
+	// file of an obsolete segment is removed as soon as it drops to zero.
+	refs     int32
+	obsolete int32
+	removed  int32
+}
+
+// logf logs through the datastore logger, segments made outside of one use
+// the standard logger.
+func (s *segment) logf(format string, v ...interface{}) {
+	if s.logger == nil {
+		log.Printf(format, v...)
+
+		return
+	}
+
+	s.logger.Printf(format, v...)
+}
+
+func (s *segment) suffix() string {
+	return strings.TrimPrefix(filepath.Base(s.path), segmentPrefix)
+}
+
+// id returns the number of a sealed segment or -1 for any other file.
+func (s *segment) id() int {
+	n, err := strconv.Atoi(s.suffix())
+	if err != nil || n < 0 {
+		return -1
+	}
+
+	return n
+}
+
+// newerThan orders segments the way lookups walk them: the active segment
+// goes first, then sealed segments from the latest written to the earliest.
+func (s *segment) newerThan(other *segment) bool {
+	if s.suffix() == currentSegmentSuffix || other.suffix() == currentSegmentSuffix {
+		return s.suffix() == currentSegmentSuffix && other.suffix() != currentSegmentSuffix
+	}
+
+	if s.seq != other.seq {
+		return s.seq > other.seq
+	}
+
+	return s.id() > other.id()
+}
+
+func (s *segment) pin() {
+	atomic.AddInt32(&s.refs, 1)
+}
+
+// unpin removes the file of an obsolete segment once no reader is left. The
+// count is checked again after the segment is seen obsolete, since a reader
+// may pin it until it is retired but never after.
+func (s *segment) unpin() {
+	atomic.AddInt32(&s.refs, -1)
+
+	if atomic.LoadInt32(&s.obsolete) == 1 && atomic.LoadInt32(&s.refs) == 0 {
+		s.remove()
+	}
+}
+
+// retire marks a segment replaced by merge, its file stays on disk until the
+// last reader pinning it is gone.
+func (s *segment) retire() {
+	atomic.StoreInt32(&s.obsolete, 1)
+
+	if atomic.LoadInt32(&s.refs) == 0 {
+		s.remove()
+	}
+}
+
+func (s *segment) remove() {
+	if !atomic.CompareAndSwapInt32(&s.removed, 0, 1) {
+		return
+	}
+
+	if err := os.Remove(s.path); err != nil {
+		s.logf("can't remove merged segment: %v", err)
+	}
+
+	for _, suffix := range []string{hintSuffix, bloomSuffix} {
+		if err := os.Remove(s.path + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.logf("can't remove %s file of merged segment: %v", suffix, err)
+		}
+	}
 }
 
 func (s *segment) restore() error {
@@ -35,82 +150,177 @@ func (s *segment) restore() error {
 		}
 	}(input)
 
-	var buffer [bufferSize]byte
-
 	in := bufio.NewReaderSize(input, bufferSize)
 
-	for err == nil {
+	for {
 		var (
-			header, data []byte
-			n            int
+			e *entry
+			n int
 		)
 
-		header, err = in.Peek(bufferSize)
+		e, n, err = readEntry(in)
 		if errors.Is(err, io.EOF) {
-			if len(header) == 0 {
-				return err
-			}
-		} else if err != nil {
 			return err
+		} else if err != nil {
+			return corrupted(s.path, s.offset, err)
 		}
 
-		size := binary.LittleEndian.Uint32(header)
-		if size < bufferSize {
-			data = buffer[:size]
-		} else {
-			data = make([]byte, size)
+		switch e.kind {
+		case entryBatch:
+			if n, err = s.restoreBatch(in, e, n); err != nil {
+				return corrupted(s.path, s.offset, err)
+			}
+		case entryHeader:
+			s.setHeader(e, n)
+		default:
+			s.index[e.key] = position{offset: s.offset, size: int64(n)}
+			s.seen(e)
 		}
 
-		n, err = in.Read(data)
-		if err == nil {
-			if n != int(size) {
-				return ErrCorruptedFile
-			}
+		s.offset += int64(n)
+	}
+}
 
-			var e entry
+// restoreBatch indexes the records following a batch header only once all of
+// them have been read, returning the size of the whole batch.
+func (s *segment) restoreBatch(in *bufio.Reader, header *entry, size int) (int, error) {
+	if len(header.value) != 4 {
+		return 0, ErrCorruptedFile
+	}
 
-			e.Decode(data)
+	count := int(binary.LittleEndian.Uint32(header.value))
+	entries := make([]*entry, 0, count)
+	positions := make([]position, 0, count)
 
-			s.index[e.key] = s.offset
-			s.offset += int64(n)
+	for i := 0; i < count; i++ {
+		e, n, err := readEntry(in)
+		if errors.Is(err, io.EOF) || (err == nil && e.kind != entryPut && e.kind != entryDelete) {
+			return 0, ErrCorruptedFile
+		} else if err != nil {
+			return 0, err
 		}
+
+		entries = append(entries, e)
+		positions = append(positions, position{offset: s.offset + int64(size), size: int64(n)})
+		size += n
 	}
 
-	return err
+	for i, e := range entries {
+		s.index[e.key] = positions[i]
+		s.seen(e)
+	}
+
+	return size, nil
 }
 
-func (s *segment) get(key string) ([]byte, error) {
-	position, ok := s.index[key]
-	if !ok {
-		if position != 0 {
-			print()
-		} else {
-			return nil, ErrNotFound
-		}
+// recover restores the active segment, truncating a record torn by a crash
+// in the middle of a write so that the segment ends at the last valid one.
+// Damage followed by valid records is reported instead, as truncating would
+// drop acknowledged writes.
+func (s *segment) recover() error {
+	err := s.restore()
+	if !errors.Is(err, ErrCorruptedFile) {
+		return err
 	}
 
-	file, err := os.Open(s.path)
+	size, err := s.torn()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	defer func(file *os.File) {
-		err = file.Close()
-		if err != nil {
-			log.Panic(err)
+	if err = os.Truncate(s.path, s.offset); err != nil {
+		return err
+	}
+
+	s.logf("recovered %s: dropped %d bytes after offset %d", s.path, size-s.offset, s.offset)
+
+	return io.EOF
+}
+
+// torn checks that the segment ends in what a write cut short leaves behind:
+// the intact records of an unfinished batch followed by a partial or garbled
+// record, with no valid record after it. It returns the size of the file.
+func (s *segment) torn() (int64, error) {
+	input, err := os.Open(s.path)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func(input *os.File) {
+		_ = input.Close()
+	}(input)
+
+	tail, err := ioutil.ReadAll(io.NewSectionReader(input, s.offset, math.MaxInt64-s.offset))
+	if err != nil {
+		return 0, err
+	}
+
+	pos := 0
+
+	for pos < len(tail) {
+		n := validRecord(tail[pos:])
+		if n == 0 {
+			break
 		}
-	}(file)
 
-	if _, err = file.Seek(position, 0); err != nil {
-		return nil, err
+		pos += n
 	}
 
-	reader := bufio.NewReader(file)
+	for i := pos + 1; i < len(tail); i++ {
+		if validRecord(tail[i:]) > 0 {
+			return 0, corrupted(s.path, s.offset+int64(pos), ErrCorruptedFile)
+		}
+	}
+
+	return s.offset + int64(len(tail)), nil
+}
+
+// validRecord returns the size of the intact record data starts with, or
+// zero if there is none.
+func validRecord(data []byte) int {
+	if len(data) < entryHeaderSize {
+		return 0
+	}
+
+	size := int(binary.LittleEndian.Uint32(data))
+	if size < entryHeaderSize || size > len(data) || data[8] > entryHeader {
+		return 0
+	}
+
+	var e entry
+
+	if e.Decode(data[:size]) != nil {
+		return 0
+	}
+
+	return size
+}
+
+func (s *segment) seen(e *entry) {
+	if e.seq > s.seq {
+		s.seq = e.seq
+	}
+}
+
+// corrupted attaches the segment path and record offset to read errors.
+func corrupted(path string, offset int64, err error) error {
+	if !errors.Is(err, ErrCorruptedFile) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %s at offset %d", ErrCorruptedFile, path, offset)
+}
+
+// entryAt reads the whole record at position in an opened segment.
+func entryAt(file *os.File, position int64) (*entry, error) {
+	e, _, err := readEntryAt(file, position)
+	if errors.Is(err, io.EOF) {
+		err = ErrCorruptedFile
+	}
 
-	value, err := readValue(reader)
 	if err != nil {
-		return nil, err
+		return nil, corrupted(file.Name(), position, err)
 	}
 
-	return value, nil
+	return e, nil
 }
@@ -0,0 +1,219 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// view is a set of segments pinned against removal by merge. A live view
+// looks keys up in the active segment as it grows, a frozen one keeps a copy
+// of its index taken together with the segments.
+type view struct {
+	db       *Datastore
+	seq      uint64
+	segments []*segment
+	active   hashIndex
+}
+
+func (db *Datastore) pin(frozen bool) *view {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	v := &view{
+		db:       db,
+		seq:      db.seq,
+		segments: make([]*segment, len(db.segments)),
+	}
+
+	copy(v.segments, db.segments)
+
+	for _, seg := range v.segments {
+		seg.pin()
+	}
+
+	if frozen {
+		v.active = make(hashIndex, len(db.segments[0].index))
+		for key, position := range db.segments[0].index {
+			v.active[key] = position
+		}
+	}
+
+	return v
+}
+
+func (v *view) release() {
+	for _, seg := range v.segments {
+		seg.unpin()
+	}
+}
+
+// index returns the index of the i-th segment, locking the mutex for the
+// duration of f when the index may still be written to.
+func (v *view) index(i int, f func(index hashIndex)) {
+	switch {
+	case i > 0:
+		f(v.segments[i].index)
+	case v.active != nil:
+		f(v.active)
+	default:
+		v.db.mutex.RLock()
+		defer v.db.mutex.RUnlock()
+
+		f(v.segments[0].index)
+	}
+}
+
+func (v *view) get(key string) ([]byte, error) {
+	value, _, err := v.getWithVersion(key)
+
+	return value, err
+}
+
+func (v *view) getWithVersion(key string) ([]byte, uint64, error) {
+	e, err := v.lookup(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	value, err := e.live(time.Now())
+
+	// A tombstone shadows whatever older segments still hold for the key.
+	if errors.Is(err, errDeleted) {
+		return nil, 0, ErrNotFound
+	}
+
+	return value, e.version, err
+}
+
+// lookup returns the latest record of the key, which may be a tombstone.
+func (v *view) lookup(key string) (*entry, error) {
+	for i, seg := range v.segments {
+		var (
+			pos position
+			ok  bool
+		)
+
+		// Only segments sealed before the view was taken have a filter.
+		filtered := i > 0 && seg.filter != nil
+		if filtered && !seg.filter.mayContain(key) {
+			atomic.AddInt64(&v.db.bloomNegatives, 1)
+
+			continue
+		}
+
+		v.index(i, func(index hashIndex) {
+			pos, ok = index[key]
+		})
+
+		if !ok {
+			if filtered {
+				atomic.AddInt64(&v.db.bloomFalsePositives, 1)
+			}
+
+			continue
+		}
+
+		return v.db.read(seg, pos.offset)
+	}
+
+	return nil, ErrNotFound
+}
+
+// keys returns every key in the [start, end) range, including deleted ones.
+func (v *view) keys(start, end string) []string {
+	seen := make(map[string]struct{})
+
+	for i := range v.segments {
+		v.index(i, func(index hashIndex) {
+			for key := range index {
+				if key >= start && (end == "" || key < end) {
+					seen[key] = struct{}{}
+				}
+			}
+		})
+	}
+
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// read looks the record up through the file cache. Segment files are opened
+// under the mutex since sealing the active segment renames it.
+func (db *Datastore) read(seg *segment, position int64) (*entry, error) {
+	of, err := db.files.acquire(seg, func() (*os.File, error) {
+		db.mutex.RLock()
+		defer db.mutex.RUnlock()
+
+		return os.Open(seg.path)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	defer db.files.release(of)
+
+	e, err := entryAt(of.file, position)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = db.decode(seg, e); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Snapshot is a read-only view of the datastore as of a sequence number.
+// Segments it reads from are kept on disk until it is released.
+type Snapshot struct {
+	db   *Datastore
+	view *view
+	once sync.Once
+}
+
+func (db *Datastore) Snapshot() *Snapshot {
+	return &Snapshot{db: db, view: db.pin(true)}
+}
+
+// Seq returns the sequence number of the latest write the snapshot sees.
+func (s *Snapshot) Seq() uint64 {
+	return s.view.seq
+}
+
+func (s *Snapshot) Get(key string) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	if err := s.db.acquire(); err != nil {
+		return nil, err
+	}
+
+	defer s.db.semaphore.Release(1)
+
+	return s.view.get(key)
+}
+
+func (s *Snapshot) Scan(start, end string) *Iterator {
+	return &Iterator{get: s.Get, keys: s.view.keys(withoutBuckets(start), end)}
+}
+
+func (s *Snapshot) Prefix(p string) *Iterator {
+	return s.Scan(p, prefixEnd(p))
+}
+
+// Release unpins the snapshot segments, letting merge remove them.
+func (s *Snapshot) Release() {
+	s.once.Do(s.view.release)
+}
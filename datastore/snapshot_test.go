@@ -0,0 +1,136 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDatastore_Snapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 44, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, val := range dataset {
+		if err = db.Put(key, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot := db.Snapshot()
+
+	for key, val := range anotherDataset {
+		if err = db.Put(key, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Put("key4", []byte("silver")); err != nil {
+		t.Fatal(err)
+	}
+
+	if snapshot.Seq() != uint64(len(dataset)) {
+		t.Errorf("unexpected snapshot sequence number %d", snapshot.Seq())
+	}
+
+	check := func(t *testing.T) {
+		for key, val := range dataset {
+			value, err := snapshot.Get(key)
+			if err != nil {
+				t.Errorf("can't get %s: %s", key, err)
+			}
+
+			if !bytes.Equal(value, val) {
+				t.Errorf("wrong value returned expected %s, got %s", val, value)
+			}
+		}
+
+		if _, err := snapshot.Get("key4"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected %s, got %v", ErrNotFound, err)
+		}
+
+		var keys []string
+
+		for it := snapshot.Prefix("key"); it.Next(); {
+			keys = append(keys, it.Key())
+		}
+
+		if len(keys) != len(dataset) {
+			t.Errorf("unexpected keys in snapshot %v", keys)
+		}
+	}
+
+	t.Run("writes", check)
+
+	t.Run("merge", func(t *testing.T) {
+		var pinned []string
+		for _, seg := range snapshot.view.segments {
+			pinned = append(pinned, seg.path)
+		}
+
+		if err = db.merge(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, path := range pinned {
+			if _, err = os.Stat(path); err != nil {
+				t.Errorf("pinned segment was removed: %s", err)
+			}
+		}
+
+		check(t)
+
+		if _, err = db.Get("key1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected %s, got %v", ErrNotFound, err)
+		}
+
+		if value, err := db.Get("key2"); err != nil || !bytes.Equal(value, anotherDataset["key2"]) {
+			t.Errorf("can't get the latest key2: %s, %v", value, err)
+		}
+	})
+
+	t.Run("release", func(t *testing.T) {
+		merged := make([]string, 0, len(snapshot.view.segments))
+		for _, seg := range snapshot.view.segments {
+			if seg.obsolete == 1 {
+				merged = append(merged, seg.path)
+			}
+		}
+
+		if len(merged) != len(snapshot.view.segments) {
+			t.Fatalf("expected every pinned segment to be merged, got %v", merged)
+		}
+
+		snapshot.Release()
+		snapshot.Release()
+
+		for _, path := range merged {
+			if _, err = os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("merged segment %s was not removed on release", path)
+			}
+		}
+	})
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,128 @@
+package datastore
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a point-in-time report on the datastore internals.
+type Stats struct {
+	// Segments lists the segments from the newest, the active one first.
+	Segments []SegmentStats
+	// Size is the total size of the segments.
+	Size int64
+	// DeadBytes is the size of overwritten records merges have yet to drop.
+	DeadBytes int64
+	// LiveKeys counts the keys holding a value, bucket keys included.
+	LiveKeys int
+
+	// Merges counts the merges made since the datastore was opened,
+	// MergeDuration is the time they took together.
+	Merges            int64
+	MergeDuration     time.Duration
+	LastMergeDuration time.Duration
+
+	// PutQueueDepth counts the writes waiting for or being written by the
+	// writer goroutine.
+	PutQueueDepth int64
+	// SemaphoreWait is the time reads spent waiting for a read slot.
+	SemaphoreWait time.Duration
+
+	// BloomNegatives counts segment lookups skipped by a bloom filter.
+	BloomNegatives int64
+	// BloomFalsePositives counts lookups a bloom filter let through for keys
+	// the segment does not hold.
+	BloomFalsePositives int64
+	// BloomFalsePositiveRate is the observed share of false positives among
+	// lookups of keys missing from sealed segments.
+	BloomFalsePositiveRate float64
+
+	// CompactionRate is the compaction budget in bytes per second, zero when
+	// compaction is not throttled.
+	CompactionRate int64
+	// CompactionBytes counts bytes read and written by compaction.
+	CompactionBytes int64
+	// CompactionThrottled is the time compaction spent waiting for budget.
+	CompactionThrottled time.Duration
+}
+
+// Stats collects the report. Counting live keys reads the latest record of
+// every key, so it is not meant to be polled often on large datastores. Keys
+// that cannot be read are not counted.
+func (db *Datastore) Stats() Stats {
+	v := db.pin(true)
+	defer v.release()
+
+	stats := db.QuickStats()
+	stats.LiveKeys = v.countLive(time.Now())
+
+	return stats
+}
+
+// QuickStats collects the report but for LiveKeys, which is left zero. It
+// only reads what is kept in memory, so it can be polled as often as needed.
+func (db *Datastore) QuickStats() Stats {
+	stats := Stats{
+		Merges:              atomic.LoadInt64(&db.merges),
+		MergeDuration:       time.Duration(atomic.LoadInt64(&db.mergeTime)),
+		LastMergeDuration:   time.Duration(atomic.LoadInt64(&db.lastMergeTime)),
+		PutQueueDepth:       atomic.LoadInt64(&db.putQueue),
+		SemaphoreWait:       time.Duration(atomic.LoadInt64(&db.semaphoreWait)),
+		BloomNegatives:      atomic.LoadInt64(&db.bloomNegatives),
+		BloomFalsePositives: atomic.LoadInt64(&db.bloomFalsePositives),
+		CompactionRate:      db.compactionLimiter.getRate(),
+		CompactionBytes:     atomic.LoadInt64(&db.compactionLimiter.bytes),
+		CompactionThrottled: time.Duration(atomic.LoadInt64(&db.compactionLimiter.waited)),
+	}
+
+	if misses := stats.BloomNegatives + stats.BloomFalsePositives; misses > 0 {
+		stats.BloomFalsePositiveRate = float64(stats.BloomFalsePositives) / float64(misses)
+	}
+
+	db.mutex.RLock()
+
+	for _, s := range db.segments {
+		stats.Segments = append(stats.Segments, SegmentStats{ID: s.id(), Size: s.offset, LiveBytes: s.live})
+		stats.Size += s.offset
+		stats.DeadBytes += s.offset - s.live
+	}
+
+	db.mutex.RUnlock()
+
+	return stats
+}
+
+// countLive counts the keys whose latest record holds a value, reading the
+// records directly so that the bloom filter stats are left alone.
+func (v *view) countLive(now time.Time) int {
+	var (
+		seen  = make(map[string]struct{})
+		count int
+	)
+
+	for i, seg := range v.segments {
+		var latest []position
+
+		v.index(i, func(index hashIndex) {
+			for key, pos := range index {
+				if _, ok := seen[key]; !ok {
+					seen[key] = struct{}{}
+					latest = append(latest, pos)
+				}
+			}
+		})
+
+		for _, pos := range latest {
+			e, err := v.db.read(seg, pos.offset)
+			if err != nil {
+				continue
+			}
+
+			if _, err = e.live(now); err == nil {
+				count++
+			}
+		}
+	}
+
+	return count
+}
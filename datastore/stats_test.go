@@ -0,0 +1,88 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDatastore_Stats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 200, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(db *Datastore) {
+		_ = db.Close()
+	}(db)
+
+	for i := 0; i < 20; i++ {
+		if err = db.Put(fmt.Sprintf("key%d", i%10), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = db.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("segments", func(t *testing.T) {
+		stats := db.Stats()
+
+		if stats.LiveKeys != 9 {
+			t.Errorf("got %d live keys, want 9", stats.LiveKeys)
+		}
+
+		if len(stats.Segments) < 3 || stats.Segments[0].ID != -1 {
+			t.Errorf("unexpected segments %+v", stats.Segments)
+		}
+
+		if quick := db.QuickStats(); quick.LiveKeys != 0 || quick.Size != stats.Size {
+			t.Errorf("unexpected quick stats %+v", quick)
+		}
+
+		var size int64
+		for _, s := range stats.Segments {
+			size += s.Size
+		}
+
+		if size != stats.Size || stats.DeadBytes <= 0 || stats.DeadBytes >= stats.Size {
+			t.Errorf("size %d, dead bytes %d of segments %+v", stats.Size, stats.DeadBytes, stats.Segments)
+		}
+
+		if stats.PutQueueDepth != 0 || stats.Merges != 0 {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		before := db.Stats()
+
+		if err = db.merge(); err != nil {
+			t.Fatal(err)
+		}
+
+		stats := db.Stats()
+
+		if stats.Merges != 1 || stats.MergeDuration <= 0 || stats.LastMergeDuration != stats.MergeDuration {
+			t.Errorf("unexpected merge stats %+v", stats)
+		}
+
+		if stats.DeadBytes >= before.DeadBytes || stats.LiveKeys != 9 {
+			t.Errorf("%d dead bytes and %d live keys after merge", stats.DeadBytes, stats.LiveKeys)
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// SyncMode tells when writes to the active segment are flushed to disk.
+type SyncMode int
+
+const (
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncMode = iota
+	// SyncAlways acknowledges a write only after it has been fsynced.
+	// Writes queued at the same time share a single fsync.
+	SyncAlways
+	// SyncInterval fsyncs the active segment in the background once per interval.
+	SyncInterval
+)
+
+func (m SyncMode) String() string {
+	switch m {
+	case SyncNever:
+		return "never"
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	default:
+		return fmt.Sprintf("SyncMode(%d)", int(m))
+	}
+}
+
+// ParseSyncMode is the inverse of SyncMode.String.
+func ParseSyncMode(s string) (SyncMode, error) {
+	for _, mode := range []SyncMode{SyncNever, SyncAlways, SyncInterval} {
+		if mode.String() == s {
+			return mode, nil
+		}
+	}
+
+	return SyncNever, fmt.Errorf("unknown sync mode %q", s)
+}
+
+func (db *Datastore) SyncMode() (SyncMode, time.Duration) {
+	db.syncMutex.Lock()
+	defer db.syncMutex.Unlock()
+
+	return db.syncMode, db.syncInterval
+}
+
+// SetSyncMode switches the durability of subsequent writes. The interval is
+// only used by SyncInterval and must be positive for it.
+func (db *Datastore) SetSyncMode(mode SyncMode, interval time.Duration) error {
+	switch mode {
+	case SyncNever, SyncAlways:
+		interval = 0
+	case SyncInterval:
+		if interval <= 0 {
+			return fmt.Errorf("sync interval must be positive, got %v", interval)
+		}
+	default:
+		return fmt.Errorf("unknown sync mode %v", mode)
+	}
+
+	if db.readOnly && mode != SyncNever {
+		return ErrReadOnly
+	}
+
+	db.stopSyncing()
+
+	db.syncMutex.Lock()
+	defer db.syncMutex.Unlock()
+
+	db.syncMode = mode
+	db.syncInterval = interval
+
+	if mode == SyncInterval {
+		db.syncDone = make(chan struct{})
+
+		go db.syncEvery(interval, db.syncDone)
+	}
+
+	return nil
+}
+
+func (db *Datastore) stopSyncing() {
+	db.syncMutex.Lock()
+	defer db.syncMutex.Unlock()
+
+	if db.syncDone != nil {
+		close(db.syncDone)
+		db.syncDone = nil
+	}
+}
+
+func (db *Datastore) syncEvery(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_ = db.sync()
+		case <-done:
+			return
+		}
+	}
+}
+
+// sync flushes the active segment. A segment sealed in the meantime has
+// already been flushed by addSegment, so its closed descriptor is ignored.
+func (db *Datastore) sync() error {
+	db.mutex.RLock()
+	out := db.out
+	db.mutex.RUnlock()
+
+	if err := out.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+
+	atomic.AddInt64(&db.syncs, 1)
+
+	return nil
+}
+
+// drain collects the writes already waiting on putChannel behind the first
+// one so that they can be committed together. It also reports whether Close
+// has been requested meanwhile.
+func (db *Datastore) drain(batch []putQuery) ([]putQuery, bool) {
+	for {
+		select {
+		case pe := <-db.putChannel:
+			if pe.entries == nil {
+				return batch, true
+			}
+
+			batch = append(batch, pe)
+		default:
+			return batch, false
+		}
+	}
+}
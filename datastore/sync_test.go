@@ -0,0 +1,174 @@
+package datastore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDatastore_GroupCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.SetSyncMode(SyncAlways, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var batch []putQuery
+
+	for key, val := range bigDataset {
+		batch = append(batch, putQuery{
+			entries:  []*entry{{key: key, value: val}},
+			callback: make(chan error, 1),
+		})
+	}
+
+	if err = db.put(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pe := range batch {
+		if err = <-pe.callback; err != nil {
+			t.Errorf("can't put %s: %s", pe.entries[0].key, err)
+		}
+	}
+
+	if syncs := atomic.LoadInt64(&db.syncs); syncs != 1 {
+		t.Errorf("expected a single fsync for the batch, got %d", syncs)
+	}
+
+	for key, val := range bigDataset {
+		value, err := db.Get(key)
+		if err != nil {
+			t.Errorf("can't get %s: %s", key, err)
+		}
+
+		if !bytes.Equal(value, val) {
+			t.Errorf("wrong value returned expected %s, got %s", val, value)
+		}
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDatastore_GroupCommitConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := Open(dir, WithSyncMode(SyncAlways, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The writer goroutine stalls on the first write while the others queue
+	// up behind it.
+	db.mutex.Lock()
+
+	errs := make(chan error, len(bigDataset))
+
+	for key, val := range bigDataset {
+		go func(key string, val []byte) {
+			errs <- db.Put(key, val)
+		}(key, val)
+	}
+
+	for atomic.LoadInt64(&db.putQueue) < int64(len(bigDataset)) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Let the last callers get from counting themselves to the channel.
+	time.Sleep(10 * time.Millisecond)
+	db.mutex.Unlock()
+
+	for range bigDataset {
+		if err = <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	if syncs := atomic.LoadInt64(&db.syncs); syncs != 2 {
+		t.Errorf("expected the queued writes to share an fsync, got %d fsyncs", syncs)
+	}
+
+	for key, val := range bigDataset {
+		if value, err := db.Get(key); err != nil || !bytes.Equal(value, val) {
+			t.Errorf("can't get %s: %v", key, err)
+		}
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDatastore_SyncInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.SetSyncMode(SyncInterval, 0); err == nil {
+		t.Error("expected an error for a zero sync interval")
+	}
+
+	if err = db.SetSyncMode(SyncInterval, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Put("key1", []byte("purple")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&db.syncs) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if atomic.LoadInt64(&db.syncs) == 0 {
+		t.Error("active segment was never synced")
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
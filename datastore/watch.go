@@ -0,0 +1,100 @@
+package datastore
+
+import (
+	"context"
+	"strings"
+)
+
+// Event is a change of a key. Value is nil for deletes.
+type Event struct {
+	Seq     uint64
+	Key     string
+	Value   []byte
+	Deleted bool
+}
+
+// Watcher delivers the changes of keys with a prefix in the order they were
+// made. A slow reader does not hold writes back, it catches up from the
+// segments instead.
+type Watcher struct {
+	events chan Event
+	cancel context.CancelFunc
+	err    error
+}
+
+// Watch follows the changes made after the from sequence number to the keys
+// starting with prefix. Pass Seq() to only see changes made from now on.
+func (db *Datastore) Watch(prefix string, from uint64) *Watcher {
+	return db.watch("", prefix, from)
+}
+
+// watch follows the keys of a bucket, or of the datastore itself for an empty
+// bucket prefix, reporting them without the bucket prefix.
+func (db *Datastore) watch(bucket, prefix string, from uint64) *Watcher {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w := &Watcher{
+		events: make(chan Event),
+		cancel: cancel,
+	}
+
+	go w.run(ctx, db, bucket, prefix, from)
+
+	return w
+}
+
+func (w *Watcher) run(ctx context.Context, db *Datastore, bucket, prefix string, seq uint64) {
+	defer close(w.events)
+
+	for {
+		records, latest, err := db.changes(seq)
+		if err != nil {
+			w.err = err
+
+			return
+		}
+
+		for _, e := range records {
+			if !strings.HasPrefix(e.key, bucket+prefix) || (bucket == "" && strings.HasPrefix(e.key, bucketMark)) {
+				continue
+			}
+
+			event := Event{Seq: e.seq, Key: e.key[len(bucket):]}
+			if e.kind == entryDelete {
+				event.Deleted = true
+			} else {
+				event.Value = e.value
+			}
+
+			select {
+			case w.events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		seq = latest
+
+		if err = db.WaitForChanges(ctx, seq); err != nil {
+			return
+		}
+	}
+}
+
+// Events returns the channel of changes, it is closed once the watcher is
+// closed or fails.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Err returns the error that stopped the watcher, ErrHistoryTruncated if
+// merges have dropped changes it still had to deliver or it started ahead of
+// the datastore. It is only set once the events channel is closed.
+func (w *Watcher) Err() error {
+	return w.err
+}
+
+// Close stops the watcher.
+func (w *Watcher) Close() {
+	w.cancel()
+}
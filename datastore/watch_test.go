@@ -0,0 +1,193 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDatastore_Watch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(db *Datastore) {
+		_ = db.Close()
+	}(db)
+
+	if err = db.Put("user/1", []byte("purple")); err != nil {
+		t.Fatal(err)
+	}
+
+	from := db.Seq()
+	w := db.Watch("user/", from)
+
+	defer w.Close()
+
+	if err = db.Put("user/2", []byte("orange")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Put("order/1", []byte("silver")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Delete("user/1"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Event{
+		{Seq: from + 1, Key: "user/2", Value: []byte("orange")},
+		{Seq: from + 3, Key: "user/1", Deleted: true},
+	}
+
+	next := func(t *testing.T, w *Watcher) Event {
+		t.Helper()
+
+		select {
+		case event, ok := <-w.Events():
+			if !ok {
+				t.Fatalf("watcher stopped: %v", w.Err())
+			}
+
+			return event
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+		}
+
+		return Event{}
+	}
+
+	t.Run("events", func(t *testing.T) {
+		for _, want := range expected {
+			if event := next(t, w); !reflect.DeepEqual(event, want) {
+				t.Errorf("got %+v, want %+v", event, want)
+			}
+		}
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		resumed := db.Watch("user/", expected[0].Seq)
+		defer resumed.Close()
+
+		if event := next(t, resumed); !reflect.DeepEqual(event, expected[1]) {
+			t.Errorf("got %+v, want %+v", event, expected[1])
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		w.Close()
+
+		select {
+		case _, ok := <-w.Events():
+			if ok {
+				t.Error("event after close")
+			}
+		case <-time.After(time.Second):
+			t.Error("events are not closed")
+		}
+	})
+}
+
+func TestDatastore_WatchSealing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	db, err := NewDatastoreMergeToSize(dir, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(db *Datastore) {
+		_ = db.Close()
+	}(db)
+
+	const writes = 1000
+
+	w := db.Watch("", 0)
+	defer w.Close()
+
+	done := make(chan error, 1)
+
+	// Every few writes seal the active segment while changes are read.
+	go func() {
+		for i := 0; i < writes; i++ {
+			if err := db.Put(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+				done <- err
+
+				return
+			}
+		}
+
+		done <- nil
+	}()
+
+	t.Run("changes", func(t *testing.T) {
+		for seq := uint64(0); seq < writes; {
+			records, latest, err := db.changes(seq)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, e := range records {
+				if e.seq != seq+1 {
+					t.Fatalf("got seq %d after %d", e.seq, seq)
+				}
+
+				seq = e.seq
+			}
+
+			if latest != seq {
+				t.Fatalf("changes reached %d, records end at %d", latest, seq)
+			}
+		}
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		for seq := uint64(0); seq < writes; {
+			select {
+			case event, ok := <-w.Events():
+				if !ok {
+					t.Fatalf("watcher stopped: %v", w.Err())
+				}
+
+				if event.Seq != seq+1 {
+					t.Fatalf("got seq %d after %d", event.Seq, seq)
+				}
+
+				seq = event.Seq
+			case <-time.After(time.Second):
+				t.Fatalf("no event after %d", seq)
+			}
+		}
+	})
+
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
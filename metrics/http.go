@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HTTPMetrics are the request metrics of a server.
+type HTTPMetrics struct {
+	requests *Counter
+	duration *Histogram
+}
+
+// NewHTTPMetrics registers request counts and latencies by route, method and
+// status code.
+func NewHTTPMetrics(r *Registry) *HTTPMetrics {
+	return &HTTPMetrics{
+		requests: r.Counter("http_requests_total", "Requests served.", "route", "method", "status"),
+		duration: r.Histogram("http_request_duration_seconds", "Time taken to serve requests.", nil, "route", "method", "status"),
+	}
+}
+
+// Observe records a request served in the given time.
+func (m *HTTPMetrics) Observe(route, method string, status int, took time.Duration) {
+	code := strconv.Itoa(status)
+
+	m.requests.Inc(route, method, code)
+	m.duration.Observe(took.Seconds(), route, method, code)
+}
+
+// InstrumentMux measures the requests served by mux, labelling them with
+// the pattern they matched so that the number of routes stays bounded.
+func (m *HTTPMetrics) InstrumentMux(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+
+		mux.ServeHTTP(sw, r)
+
+		m.Observe(route, r.Method, sw.status, time.Since(start))
+	})
+}
+
+// statusWriter remembers the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming responses working through the wrapper.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,340 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the Prometheus text exposition format served by Registry.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets suit request latencies in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var namePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Registry holds the metrics of a process and serves them in the Prometheus
+// text format.
+type Registry struct {
+	mutex    sync.Mutex
+	families []*family
+	names    map[string]struct{}
+	hooks    []func()
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]struct{})}
+}
+
+// family is a metric with all of its label combinations.
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mutex  sync.Mutex
+	series map[string]*series
+	// buckets are the upper bounds of histogram buckets.
+	buckets []float64
+	// value is set for metrics read when they are collected.
+	value func() float64
+}
+
+type series struct {
+	labels []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+// Counter is a value that only goes up.
+type Counter struct{ f *family }
+
+// Gauge is a value that goes up and down.
+type Gauge struct{ f *family }
+
+// Histogram counts observations in buckets.
+type Histogram struct{ f *family }
+
+// Counter registers a counter. Its methods take one value for each label.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{f: r.register(name, help, "counter", labels)}
+}
+
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{f: r.register(name, help, "gauge", labels)}
+}
+
+// Histogram registers a histogram with buckets of the given upper bounds,
+// DefaultBuckets if there are none.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+
+	f := r.register(name, help, "histogram", labels)
+	f.buckets = append([]float64(nil), buckets...)
+
+	sort.Float64s(f.buckets)
+
+	return &Histogram{f: f}
+}
+
+// CounterFunc registers a counter kept elsewhere, value is called whenever
+// the metrics are collected.
+func (r *Registry) CounterFunc(name, help string, value func() float64) {
+	r.register(name, help, "counter", nil).value = value
+}
+
+func (r *Registry) GaugeFunc(name, help string, value func() float64) {
+	r.register(name, help, "gauge", nil).value = value
+}
+
+// OnCollect adds a function called before the metrics are collected, letting
+// several function metrics share one expensive read.
+func (r *Registry) OnCollect(hook func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.hooks = append(r.hooks, hook)
+}
+
+// register adds a metric family, panicking on invalid or duplicate names
+// since those are programming errors.
+func (r *Registry) register(name, help, kind string, labels []string) *family {
+	if !namePattern.MatchString(name) {
+		panic(fmt.Sprintf("metrics: invalid metric name %q", name))
+	}
+
+	for _, label := range labels {
+		if !namePattern.MatchString(label) || strings.Contains(label, ":") || label == "le" {
+			panic(fmt.Sprintf("metrics: invalid label name %q of %s", label, name))
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.names[name]; ok {
+		panic(fmt.Sprintf("metrics: %s is registered twice", name))
+	}
+
+	f := &family{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]*series),
+	}
+
+	r.names[name] = struct{}{}
+	r.families = append(r.families, f)
+
+	return f
+}
+
+// get returns the series of the label values, creating it on first use. It
+// has to be called with the family mutex held.
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), values...)}
+		if f.buckets != nil {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+
+		f.series[key] = s
+	}
+
+	return s
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add increases the counter, negative values are ignored.
+func (c *Counter) Add(v float64, labels ...string) {
+	if v < 0 {
+		return
+	}
+
+	c.f.mutex.Lock()
+	defer c.f.mutex.Unlock()
+
+	c.f.get(labels).value += v
+}
+
+func (g *Gauge) Set(v float64, labels ...string) {
+	g.f.mutex.Lock()
+	defer g.f.mutex.Unlock()
+
+	g.f.get(labels).value = v
+}
+
+func (g *Gauge) Add(v float64, labels ...string) {
+	g.f.mutex.Lock()
+	defer g.f.mutex.Unlock()
+
+	g.f.get(labels).value += v
+}
+
+func (h *Histogram) Observe(v float64, labels ...string) {
+	h.f.mutex.Lock()
+	defer h.f.mutex.Unlock()
+
+	s := h.f.get(labels)
+	s.value += v
+	s.count++
+
+	if i := sort.SearchFloat64s(h.f.buckets, v); i < len(s.counts) {
+		s.counts[i]++
+	}
+}
+
+// WriteTo writes every metric in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.Lock()
+	hooks := r.hooks
+	families := r.families
+	r.mutex.Unlock()
+
+	for _, hook := range hooks {
+		hook()
+	}
+
+	out := &countingWriter{w: bufio.NewWriter(w)}
+
+	for _, f := range families {
+		f.write(out)
+	}
+
+	if out.err == nil {
+		out.err = out.w.Flush()
+	}
+
+	return out.n, out.err
+}
+
+func (r *Registry) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", ContentType)
+
+	_, _ = r.WriteTo(rw)
+}
+
+func (f *family) write(out *countingWriter) {
+	out.printf("# HELP %s %s\n", f.name, escape(f.help, false))
+	out.printf("# TYPE %s %s\n", f.name, f.kind)
+
+	if f.value != nil {
+		out.printf("%s %s\n", f.name, format(f.value()))
+
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		labels := f.labelPairs(s.labels)
+
+		if f.buckets == nil {
+			out.printf("%s%s %s\n", f.name, braces(labels), format(s.value))
+
+			continue
+		}
+
+		var cumulative uint64
+
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			out.printf("%s_bucket%s %d\n", f.name, braces(append(labels, `le="`+format(bound)+`"`)), cumulative)
+		}
+
+		out.printf("%s_bucket%s %d\n", f.name, braces(append(labels, `le="+Inf"`)), s.count)
+		out.printf("%s_sum%s %s\n", f.name, braces(labels), format(s.value))
+		out.printf("%s_count%s %d\n", f.name, braces(labels), s.count)
+	}
+}
+
+func (f *family) labelPairs(values []string) []string {
+	pairs := make([]string, len(values), len(values)+1)
+	for i, value := range values {
+		pairs[i] = f.labels[i] + `="` + escape(value, true) + `"`
+	}
+
+	return pairs
+}
+
+func braces(pairs []string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escape escapes help texts and, with quotes, label values.
+func escape(s string, quotes bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+
+	if quotes {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+
+	return s
+}
+
+func format(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// countingWriter keeps the first error, so that writes can be chained.
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) printf(format string, args ...interface{}) {
+	if w.err != nil {
+		return
+	}
+
+	n, err := fmt.Fprintf(w.w, format, args...)
+	w.n += int64(n)
+	w.err = err
+}
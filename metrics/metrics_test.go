@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	requests := r.Counter("requests_total", "Requests served.", "path")
+	requests.Inc("/a")
+	requests.Add(2, `/b"\`)
+	requests.Add(-1, "/a")
+
+	temperature := r.Gauge("temperature", "Current\ntemperature.")
+	temperature.Set(21.5)
+	temperature.Add(-1)
+
+	latency := r.Histogram("latency_seconds", "Latency.", []float64{1, 0.1})
+	latency.Observe(0.05)
+	latency.Observe(0.1)
+	latency.Observe(3)
+
+	calls := 0
+
+	r.OnCollect(func() {
+		calls++
+	})
+	r.GaugeFunc("calls", "Collections.", func() float64 {
+		return float64(calls)
+	})
+
+	var out bytes.Buffer
+
+	n, err := r.WriteTo(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(out.Len()) {
+		t.Errorf("wrote %d bytes, reported %d", out.Len(), n)
+	}
+
+	expected := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{path="/a"} 1
+requests_total{path="/b\"\\"} 2
+# HELP temperature Current\ntemperature.
+# TYPE temperature gauge
+temperature 20.5
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 3.15
+latency_seconds_count 3
+# HELP calls Collections.
+# TYPE calls gauge
+calls 1
+`
+	if out.String() != expected {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), expected)
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		for name, register := range map[string]func(){
+			"duplicate": func() { r.Gauge("temperature", "") },
+			"name":      func() { r.Gauge("0temperature", "") },
+			"label":     func() { r.Gauge("humidity", "", "le") },
+			"values":    func() { requests.Inc() },
+		} {
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Errorf("%s did not panic", name)
+					}
+				}()
+
+				register()
+			}()
+		}
+	})
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	r := NewRegistry()
+	m := NewHTTPMetrics(r)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	mux.HandleFunc("/items/", func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+	})
+
+	server := httptest.NewServer(m.InstrumentMux(mux))
+	defer server.Close()
+
+	for _, path := range []string{"/items/1", "/items/2", "/metrics"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = resp.Body.Close()
+	}
+
+	m.Observe("/slow", http.MethodGet, http.StatusOK, 2*time.Second)
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.Header.Get("Content-Type") != ContentType {
+		t.Errorf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		`http_requests_total{route="/items/",method="GET",status="404"} 2`,
+		`http_requests_total{route="/metrics",method="GET",status="200"} 1`,
+		`http_request_duration_seconds_bucket{route="/slow",method="GET",status="200",le="1"} 0`,
+		`http_request_duration_seconds_bucket{route="/slow",method="GET",status="200",le="2.5"} 1`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("no %s in\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jn-lp/se-lab22/datastore"
+)
+
+const retryInterval = time.Second
+
+// Status describes how far a follower is behind its leader.
+type Status struct {
+	Leader string
+	// LeaderSeq is the latest sequence number the leader reported.
+	LeaderSeq  uint64
+	AppliedSeq uint64
+	// Lag is the number of writes the follower is known to miss.
+	Lag         uint64
+	LastContact time.Time
+	Error       string `json:",omitempty"`
+}
+
+// Follower tails the log of a leader and applies it to a local datastore in
+// order, the datastore must not be written to otherwise.
+type Follower struct {
+	db     *datastore.Datastore
+	leader string
+	client *http.Client
+	wait   time.Duration
+
+	mutex  sync.Mutex
+	status Status
+}
+
+func NewFollower(db *datastore.Datastore, leader string) *Follower {
+	return &Follower{
+		db:     db,
+		leader: leader,
+		client: &http.Client{Timeout: maxWait + 5*time.Second},
+		wait:   maxWait,
+		status: Status{Leader: leader},
+	}
+}
+
+// Run replicates the leader until the context is done.
+func (f *Follower) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := f.poll(ctx)
+
+		f.mutex.Lock()
+		f.status.AppliedSeq = f.db.Seq()
+		if f.status.LeaderSeq > f.status.AppliedSeq {
+			f.status.Lag = f.status.LeaderSeq - f.status.AppliedSeq
+		} else {
+			f.status.Lag = 0
+		}
+		f.status.Error = ""
+		if err != nil {
+			f.status.Error = err.Error()
+		}
+		f.mutex.Unlock()
+
+		if err != nil && ctx.Err() == nil {
+			log.Printf("cannot replicate %s: %v", f.leader, err)
+
+			select {
+			case <-time.After(retryInterval):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// poll applies the next part of the log, starting over from a snapshot if
+// the leader no longer has the records the follower needs.
+func (f *Follower) poll(ctx context.Context) error {
+	query := url.Values{
+		"from": {strconv.FormatUint(f.db.Seq(), 10)},
+		"wait": {f.wait.String()},
+	}
+
+	data, seq, err := f.get(ctx, LogPath+"?"+query.Encode())
+	if errors.Is(err, errGone) {
+		if data, seq, err = f.get(ctx, SnapshotPath); err != nil {
+			return err
+		}
+
+		log.Printf("loading snapshot of %s at %d", f.leader, seq)
+
+		return f.db.Load(data, seq)
+	} else if err != nil {
+		return err
+	}
+
+	return f.db.Apply(data, seq)
+}
+
+var errGone = errors.New("leader history is gone")
+
+func (f *Follower) get(ctx context.Context, path string) ([]byte, uint64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.leader+path, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode == http.StatusGone {
+		return nil, 0, errGone
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+
+	seq, err := strconv.ParseUint(resp.Header.Get(SeqHeader), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid %s header: %w", SeqHeader, err)
+	}
+
+	leaderSeq, err := strconv.ParseUint(resp.Header.Get(LeaderSeqHeader), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid %s header: %w", LeaderSeqHeader, err)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	f.mutex.Lock()
+	f.status.LeaderSeq = leaderSeq
+	f.status.LastContact = time.Now()
+	f.mutex.Unlock()
+
+	return data, seq, nil
+}
+
+// Status returns the replication state as of the last poll.
+func (f *Follower) Status() Status {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.status
+}
+
+// ServeHTTP reports the status as JSON.
+func (f *Follower) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(rw).Encode(f.Status()); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,115 @@
+// Package replication streams the writes of a leader datastore to followers
+// over HTTP.
+package replication
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jn-lp/se-lab22/datastore"
+)
+
+const (
+	LogPath      = "/replication/log"
+	SnapshotPath = "/replication/snapshot"
+	StatusPath   = "/replication/status"
+
+	// SeqHeader carries the sequence number the response brings a follower
+	// to and LeaderSeqHeader the latest one of the leader.
+	SeqHeader       = "X-Replication-Seq"
+	LeaderSeqHeader = "X-Replication-Leader-Seq"
+
+	// maxWait keeps long polls well within the server write timeout.
+	maxWait = 5 * time.Second
+)
+
+// Handler serves the log and the snapshot of a leader. The log endpoint
+// returns records following the from sequence number, waiting up to wait for
+// new ones, or 410 Gone when a follower has to start over from a snapshot.
+func Handler(db *datastore.Datastore) http.Handler {
+	h := http.NewServeMux()
+
+	h.HandleFunc(LogPath, func(rw http.ResponseWriter, r *http.Request) {
+		from, err := strconv.ParseUint(r.URL.Query().Get("from"), 10, 64)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		var wait time.Duration
+
+		if w := r.URL.Query().Get("wait"); w != "" {
+			if wait, err = time.ParseDuration(w); err != nil || wait < 0 {
+				rw.WriteHeader(http.StatusBadRequest)
+
+				return
+			}
+		}
+
+		if wait > maxWait {
+			wait = maxWait
+		}
+
+		// A follower ahead of the leader has writes the leader has lost, there
+		// is nothing to wait for.
+		if from > db.Seq() {
+			rw.WriteHeader(http.StatusGone)
+
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+
+		_ = db.WaitForChanges(ctx, from)
+
+		var buf bytes.Buffer
+
+		seq, err := db.Changes(from, &buf)
+		if errors.Is(err, datastore.ErrHistoryTruncated) {
+			rw.WriteHeader(http.StatusGone)
+
+			return
+		} else if err != nil {
+			log.Printf("cannot read changes since %d: %v", from, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		write(rw, seq, db.Seq(), buf.Bytes())
+	})
+
+	h.HandleFunc(SnapshotPath, func(rw http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+
+		seq, err := db.Dump(&buf)
+		if err != nil {
+			log.Printf("cannot dump datastore: %v", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		write(rw, seq, db.Seq(), buf.Bytes())
+	})
+
+	return h
+}
+
+func write(rw http.ResponseWriter, seq, leaderSeq uint64, data []byte) {
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set(SeqHeader, strconv.FormatUint(seq, 10))
+	rw.Header().Set(LeaderSeqHeader, strconv.FormatUint(leaderSeq, 10))
+	rw.WriteHeader(http.StatusOK)
+
+	if _, err := rw.Write(data); err != nil {
+		log.Println(err)
+	}
+}
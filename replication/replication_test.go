@@ -0,0 +1,208 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jn-lp/se-lab22/datastore"
+)
+
+func open(t *testing.T, dir string, merging bool) *datastore.Datastore {
+	t.Helper()
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := datastore.NewDatastoreMergeToSize(dir, 500, merging)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// follow runs a follower until the returned function is called.
+func follow(db *datastore.Datastore, leader string) (*Follower, func()) {
+	f := NewFollower(db, leader)
+	f.wait = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		f.Run(ctx)
+	}()
+
+	return f, func() {
+		cancel()
+		<-done
+	}
+}
+
+func waitFor(t *testing.T, leader, follower *datastore.Datastore) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if follower.Seq() >= leader.Seq() {
+			return
+		}
+	}
+
+	t.Fatalf("follower is stuck at %d, leader is at %d", follower.Seq(), leader.Seq())
+}
+
+func TestReplication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	leader := open(t, filepath.Join(dir, "leader"), true)
+	defer func(db *datastore.Datastore) {
+		_ = db.Close()
+	}(leader)
+
+	server := httptest.NewServer(Handler(leader))
+	defer server.Close()
+
+	follower := open(t, filepath.Join(dir, "follower"), false)
+	defer func(db *datastore.Datastore) {
+		_ = db.Close()
+	}(follower)
+
+	f, stop := follow(follower, server.URL)
+
+	t.Run("tail", func(t *testing.T) {
+		for i := 0; i < 50; i++ {
+			if err = leader.Put(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var batch datastore.WriteBatch
+
+		batch.Put("key0", []byte("batched"))
+		batch.Delete("key1")
+
+		if err = leader.Write(&batch); err != nil {
+			t.Fatal(err)
+		}
+
+		waitFor(t, leader, follower)
+
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("key%d", i)
+			want, wantErr := leader.Get(key)
+
+			got, err := follower.Get(key)
+			if string(got) != string(want) || !errors.Is(err, wantErr) {
+				t.Errorf("%s is %s, %v on the follower and %s, %v on the leader", key, got, err, want, wantErr)
+			}
+		}
+
+		_, version, _ := leader.GetWithVersion("key0")
+		if _, got, _ := follower.GetWithVersion("key0"); got != version {
+			t.Errorf("key0 is at version %d on the follower, want %d", got, version)
+		}
+
+		if status := f.Status(); status.Lag != 0 || status.AppliedSeq != leader.Seq() || status.Error != "" {
+			t.Errorf("unexpected status: %+v", status)
+		}
+	})
+
+	stop()
+
+	t.Run("snapshot", func(t *testing.T) {
+		// Merges drop the tombstone of key2 while the follower is away, so it
+		// has to start over from a snapshot.
+		if err = leader.Delete("key2"); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 50; i++ {
+			if err = leader.Put(fmt.Sprintf("key%d", i%10+10), []byte("updated")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if _, err = leader.Changes(follower.Seq(), ioutil.Discard); errors.Is(err, datastore.ErrHistoryTruncated) {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatal("leader history was not truncated")
+			}
+
+			if err = leader.Put("filler", []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, stop = follow(follower, server.URL)
+		defer stop()
+
+		waitFor(t, leader, follower)
+
+		if _, err = follower.Get("key2"); !errors.Is(err, datastore.ErrNotFound) {
+			t.Errorf("expected %s for key2, got %v", datastore.ErrNotFound, err)
+		}
+
+		if value, err := follower.Get("key15"); err != nil || string(value) != "updated" {
+			t.Errorf("can't get key15: %s, %v", value, err)
+		}
+
+		if value, err := follower.Get("key30"); err != nil || string(value) != "value30" {
+			t.Errorf("can't get key30: %s, %v", value, err)
+		}
+	})
+}
+
+func TestHandler_Ahead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) {
+		err = os.RemoveAll(path)
+		if err != nil {
+			t.Log(err)
+		}
+	}(dir)
+
+	leader := open(t, dir, false)
+	defer func(db *datastore.Datastore) {
+		_ = db.Close()
+	}(leader)
+
+	if err = leader.Put("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A follower past the leader has writes the leader has lost.
+	rw := httptest.NewRecorder()
+	Handler(leader).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, LogPath+"?from=2&wait=1m", nil))
+
+	if rw.Code != http.StatusGone {
+		t.Errorf("got status %d for a follower ahead of the leader, want %d", rw.Code, http.StatusGone)
+	}
+}